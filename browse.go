@@ -0,0 +1,151 @@
+// Browsing the media directory, one level at a time.
+// `/ui/stream?dir=<path>` shows the subdirectories (as albums, with their covers) and the
+// files of a single directory, with breadcrumbs to go back up; the path is relative to the
+// media directory, and may never leave it.
+//
+// © 2023 by Gwyneth Llewelyn. All rights reserved.
+// Licensed under a MIT License (see https://gwyneth-llewelyn.mit-license.org/).
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/karrick/godirwalk"
+)
+
+// Breadcrumb is one of the directories leading to the one being browsed.
+type Breadcrumb struct {
+	Name string		// directory name, as shown.
+	URL string		// where to browse it.
+	Current bool	// this is the directory being browsed.
+}
+
+// browseDirectory resolves `dir`, relative to the media directory, to an absolute path,
+// making sure that it doesn't escape from the media directory.
+func browseDirectory(dir string) (string, error) {
+	root := absPath(mediaDirectory.Get())
+	if dir == "" {
+		return root, nil
+	}
+	if filepath.IsAbs(filepath.FromSlash(dir)) {
+		return "", fmt.Errorf("%q: only paths relative to the media directory are allowed", dir)
+	}
+	path := filepath.Join(root, filepath.FromSlash(dir))
+	if !insideDirectory(root, path) {
+		return "", fmt.Errorf("%q is outside the media directory", dir)
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	if !fi.IsDir() {
+		return "", fmt.Errorf("%q is not a directory", dir)
+	}
+	return path, nil
+}
+
+// browseURL is the link for browsing a directory (given by its absolute path).
+func browseURL(dir string) string {
+	rel, err := filepath.Rel(absPath(mediaDirectory.Get()), dir)
+	if err != nil || rel == "." {
+		return urlPathPrefix + "ui/stream"
+	}
+	return urlPathPrefix + "ui/stream?dir=" + url.QueryEscape(filepath.ToSlash(rel))
+}
+
+// breadcrumbs lists all directories from the media directory down to `dir`.
+func breadcrumbs(dir string) []Breadcrumb {
+	root := absPath(mediaDirectory.Get())
+	crumbs := []Breadcrumb{{Name: filepath.Base(root), URL: browseURL(root)}}
+	rel, err := filepath.Rel(root, dir)
+	if err != nil || rel == "." {
+		crumbs[0].Current = true
+		return crumbs
+	}
+	path := root
+	for _, name := range strings.Split(rel, string(filepath.Separator)) {
+		path = filepath.Join(path, name)
+		crumbs = append(crumbs, Breadcrumb{Name: name, URL: browseURL(path)})
+	}
+	crumbs[len(crumbs) - 1].Current = true
+	return crumbs
+}
+
+// subdirectories returns the (non-hidden) directories inside `dir`, including symbolic links
+// to directories, sorted by name, with their album covers.
+func subdirectories(dir string) ([]PlayListItem, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var dirs []PlayListItem
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		path := filepath.Join(dir, entry.Name())
+		fi, err := os.Stat(path)	// follows symbolic links.
+		if err != nil || !fi.IsDir() {
+			continue
+		}
+		// The Dirent is what makes this a directory for IsDir(); for symbolic links, we need
+		// the one for the target.
+		canonical, err := filepath.EvalSymlinks(path)
+		if err != nil {
+			continue
+		}
+		de, err := godirwalk.NewDirent(canonical)
+		if err != nil {
+			logme.Debugf("browse: cannot read %q: %s\n", path, err)
+			continue
+		}
+		cover := folderCover(path)
+		if cover == "" {
+			cover = library.Cover(path)
+		}
+		dirs = append(dirs, *NewPlayListItem(*de, path, cover, fi.ModTime(), 0, false))
+	}
+	sort.Slice(dirs, func(a, b int) bool {
+		return strings.ToLower(dirs[a].Name()) < strings.ToLower(dirs[b].Name())
+	})
+	return dirs, nil
+}
+
+// Files returns the items in the library that are directly inside `dir` (i.e. not in
+// subdirectories), sorted by album and track.
+func (l *Library) Files(dir string) []PlayListItem {
+	dir = absPath(dir)
+	l.mu.RLock()
+	var items []PlayListItem
+	for path, e := range l.entries {
+		if filepath.Dir(path) == dir {
+			items = append(items, e.Item())
+		}
+	}
+	l.mu.RUnlock()
+	sortByAlbum(items)
+	return items
+}
+
+// Cover returns the cover of the first file (alphabetically) directly inside `dir` that
+// has one, or an empty string if none does.
+func (l *Library) Cover(dir string) string {
+	dir = absPath(dir)
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	var first, cover string
+	for path, e := range l.entries {
+		if filepath.Dir(path) != dir || (first != "" && path > first) {
+			continue
+		}
+		if c := e.Item().Cover(); c != "" {
+			first, cover = path, c
+		}
+	}
+	return cover
+}
@@ -0,0 +1,427 @@
+// Configuration file, environment and command-line flags.
+// Every setting has a command-line flag; the same setting can also be given on a TOML
+// configuration file, using the (long) flag name as key, or on an environment variable
+// (`STREAMDUDE_` followed by the flag name in uppercase). Flags override the environment,
+// which overrides the configuration file, which overrides the defaults.
+// On SIGUSR1, the configuration file (and the environment) are read again, and whatever
+// can be changed while running is applied right away; everything else needs a restart.
+//
+// © 2023 by Gwyneth Llewelyn. All rights reserved.
+// Licensed under a MIT License (see https://gwyneth-llewelyn.mit-license.org/).
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/coreos/go-systemd/v22/daemon"
+	flag "github.com/karrick/golf" // flag replacement library
+	"github.com/pelletier/go-toml/v2"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// configPath is where the configuration file is; it's fine if it doesn't exist.
+var configPath string
+
+// setting holds the value of an option that may be changed while running (see reloadConfig);
+// handlers read it with Get, so that they never see it half-written.
+type setting[T any] struct {
+	value atomic.Pointer[T]
+}
+
+// Get returns the current value, or the zero value if it was never set.
+func (s *setting[T]) Get() T {
+	if v := s.value.Load(); v != nil {
+		return *v
+	}
+	var zero T
+	return zero
+}
+
+// Set replaces the current value.
+func (s *setting[T]) Set(value T) {
+	s.value.Store(&value)
+}
+
+// configOption is a setting that may come from the command line, the environment or the
+// configuration file.
+type configOption struct {
+	short rune			// short flag; zero if none.
+	long string			// long flag, also used as the key on the configuration file.
+	env string			// environment variable.
+	target any			// *string, *bool or *time.Duration, or a *setting of those, for live options.
+	flag any			// where the flag is parsed into; same as target, except for settings.
+	def any				// default value, of the same type as the target.
+	live bool			// may be changed while running (see reloadConfig).
+	explicit bool		// set on the command line, which always wins.
+}
+
+// All options, in the same order as the flags.
+var configOptions []*configOption
+
+// Environment variables that predate the configuration file, and are still honoured.
+var legacyEnvironment = map[string]string{
+	"masterkey":	"LAL_MASTER_KEY",
+	"streamer":		"STREAMER_URL",
+	"adminkey":		"STREAMDUDE_ADMIN_KEY",
+}
+
+// addOption registers an option; flags must still be registered by the caller, parsing into
+// `flagVar`. Options that may change while running must be settings.
+func addOption(short rune, long string, target any, flagVar any, def any, live bool) {
+	switch target.(type) {
+		case *setting[string], *setting[bool], *setting[time.Duration]:
+		default:
+			if live {
+				panic("live option " + long + " is not a setting")
+			}
+	}
+	env, ok := legacyEnvironment[long]
+	if !ok {
+		env = "STREAMDUDE_" + strings.ToUpper(long)
+	}
+	configOptions = append(configOptions, &configOption{
+		short:	short,
+		long:	long,
+		env:	env,
+		target:	target,
+		flag:	flagVar,
+		def:	def,
+		live:	live,
+	})
+}
+
+// flagVariable is where a flag gets parsed into: the target itself, for plain variables, or
+// a new one for settings (see loadConfig).
+func flagVariable[T any](target any) *T {
+	if pv, ok := target.(*T); ok {
+		return pv
+	}
+	return new(T)
+}
+
+// stringOption registers a string flag, which may also be set on the configuration file.
+func stringOption[P *string | *setting[string]](pv P, short rune, long string, value string, live bool, description string) {
+	fv := flagVariable[string](pv)
+	addOption(short, long, pv, fv, value, live)
+	if short == 0 {
+		flag.StringVar(fv, long, value, description)
+	} else {
+		flag.StringVarP(fv, short, long, value, description)
+	}
+}
+
+// boolOption registers a boolean flag, which may also be set on the configuration file.
+func boolOption[P *bool | *setting[bool]](pv P, short rune, long string, value bool, live bool, description string) {
+	fv := flagVariable[bool](pv)
+	addOption(short, long, pv, fv, value, live)
+	if short == 0 {
+		flag.BoolVar(fv, long, value, description)
+	} else {
+		flag.BoolVarP(fv, short, long, value, description)
+	}
+}
+
+// durationOption registers a duration flag, which may also be set on the configuration file.
+func durationOption[P *time.Duration | *setting[time.Duration]](pv P, short rune, long string, value time.Duration, live bool, description string) {
+	fv := flagVariable[time.Duration](pv)
+	addOption(short, long, pv, fv, value, live)
+	if short == 0 {
+		flag.DurationVar(fv, long, value, description)
+	} else {
+		flag.DurationVarP(fv, short, long, value, description)
+	}
+}
+
+// get returns the current value.
+func (o *configOption) get() any {
+	switch target := o.target.(type) {
+		case *string:
+			return *target
+		case *bool:
+			return *target
+		case *time.Duration:
+			return *target
+		case *setting[string]:
+			return target.Get()
+		case *setting[bool]:
+			return target.Get()
+		case *setting[time.Duration]:
+			return target.Get()
+	}
+	return nil
+}
+
+// flagValue is the value parsed from the command line (or the default, without the flag).
+func (o *configOption) flagValue() any {
+	switch fv := o.flag.(type) {
+		case *string:
+			return *fv
+		case *bool:
+			return *fv
+		case *time.Duration:
+			return *fv
+	}
+	return nil
+}
+
+// set changes the current value; `value` must have the right type (see parse).
+func (o *configOption) set(value any) {
+	switch target := o.target.(type) {
+		case *string:
+			*target = value.(string)
+		case *bool:
+			*target = value.(bool)
+		case *time.Duration:
+			*target = value.(time.Duration)
+		case *setting[string]:
+			target.Set(value.(string))
+		case *setting[bool]:
+			target.Set(value.(bool))
+		case *setting[time.Duration]:
+			target.Set(value.(time.Duration))
+	}
+}
+
+// isBool is true for options that take no value on the command line.
+func (o *configOption) isBool() bool {
+	_, ok := o.def.(bool)
+	return ok
+}
+
+// parse converts a value from the configuration file (as decoded from TOML) or from the
+// environment (always a string) to the type of the option.
+func (o *configOption) parse(raw any) (any, error) {
+	switch o.def.(type) {
+		case string:
+			if s, ok := raw.(string); ok {
+				return s, nil
+			}
+		case bool:
+			switch v := raw.(type) {
+				case bool:
+					return v, nil
+				case string:
+					return strconv.ParseBool(v)
+			}
+		case time.Duration:
+			if s, ok := raw.(string); ok {
+				return time.ParseDuration(s)
+			}
+	}
+	return nil, fmt.Errorf("unexpected value %v (%T)", raw, raw)
+}
+
+// markExplicitFlags finds out which options were set on the command line. golf has no
+// way to tell, so we must go through the arguments ourselves.
+func markExplicitFlags(args []string) {
+	byShort := make(map[rune]*configOption)
+	byLong := make(map[string]*configOption)
+	for _, o := range configOptions {
+		if o.short != 0 {
+			byShort[o.short] = o
+		}
+		byLong[o.long] = o
+	}
+	// --config isn't an option, but its value must be skipped, too.
+	configFlag := &configOption{short: 'c', long: "config", target: &configPath, def: ""}
+	byShort['c'], byLong["config"] = configFlag, configFlag
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		switch {
+			case arg == "--":
+				return
+			case strings.HasPrefix(arg, "--"):
+				name, _, hasValue := strings.Cut(arg[2:], "=")
+				if o, ok := byLong[name]; ok {
+					o.explicit = true
+					if !hasValue && !o.isBool() {
+						i++		// skip the value.
+					}
+				}
+			case strings.HasPrefix(arg, "-") && len(arg) > 1:
+				// short flags may be grouped, and the last one may have its value attached.
+				for j, r := range arg[1:] {
+					o, ok := byShort[r]
+					if !ok {
+						continue
+					}
+					o.explicit = true
+					if !o.isBool() {
+						if j + len(string(r)) == len(arg) - 1 {
+							i++		// the value is on the next argument.
+						}
+						break
+					}
+				}
+			default:
+				return	// flags end with the first argument that isn't one.
+		}
+	}
+}
+
+// readConfig works out the value of all options that were not set on the command line,
+// from the environment, the configuration file at `path`, or their defaults.
+func readConfig(path string) (map[*configOption]any, error) {
+	file := make(map[string]any)
+	buf, err := os.ReadFile(path)
+	switch {
+		case errors.Is(err, fs.ErrNotExist):
+			logme.Debugf("no configuration file found at %q, using defaults\n", path)
+		case err != nil:
+			return nil, err
+		default:
+			if err = toml.Unmarshal(buf, &file); err != nil {
+				return nil, fmt.Errorf("invalid configuration file %q: %w", path, err)
+			}
+	}
+	known := make(map[string]bool)
+	values := make(map[*configOption]any)
+	for _, o := range configOptions {
+		known[o.long] = true
+		if o.explicit {
+			continue
+		}
+		value := o.def
+		if raw, ok := os.LookupEnv(o.env); ok {
+			if value, err = o.parse(raw); err != nil {
+				return nil, fmt.Errorf("invalid value for %s: %w", o.env, err)
+			}
+		} else if raw, ok := file[o.long]; ok {
+			if value, err = o.parse(raw); err != nil {
+				return nil, fmt.Errorf("invalid value for %q on %q: %w", o.long, path, err)
+			}
+		}
+		values[o] = value
+	}
+	for key := range file {
+		if !known[key] {
+			logme.Warnf("unknown setting %q on configuration file %q, ignoring\n", key, path)
+		}
+	}
+	return values, nil
+}
+
+// loadConfig applies the configuration file and the environment on startup, after the
+// command line was parsed.
+func loadConfig(path string) error {
+	markExplicitFlags(os.Args[1:])
+	values, err := readConfig(path)
+	if err != nil {
+		return err
+	}
+	for _, o := range configOptions {
+		if value, ok := values[o]; ok {
+			o.set(value)
+		} else if o.flag != o.target {
+			// settings don't get the flags directly.
+			o.set(o.flagValue())
+		}
+	}
+	return nil
+}
+
+// reloadConfig reads the configuration file and the environment again, applying all
+// changes that are safe to apply while running, and reporting all others.
+func reloadConfig() {
+	daemon.SdNotify(false, daemon.SdNotifyReloading + "\nMONOTONIC_USEC=" + monotonicUsec() + "\nSTATUS=reloading configuration")
+	status := "configuration reloaded"
+	defer func() {
+		daemon.SdNotify(false, daemon.SdNotifyReady + "\nSTATUS=" + status)
+	}()
+
+	values, err := readConfig(configPath)
+	if err != nil {
+		logme.Errorf("configuration not reloaded: %s\n", err)
+		status = "configuration not reloaded, see logs"
+		return
+	}
+	changed := make(map[string]bool)
+	var restart []string
+	for _, o := range configOptions {
+		value, ok := values[o]
+		if !ok || value == o.get() {
+			continue
+		}
+		if !o.live {
+			restart = append(restart, o.long)
+			continue
+		}
+		if o.long == "streamer" {
+			if err := validate.Var(value, "required,url"); err != nil {
+				logme.Errorf("invalid streamer URL: %q, keeping %q\n", value, streamerURL.Get())
+				continue
+			}
+		}
+		// Secrets are not logged, of course.
+		logme.Infof("configuration: %q changed\n", o.long)
+		o.set(value)
+		changed[o.long] = true
+	}
+	applyConfigChanges(changed)
+	if len(restart) > 0 {
+		sort.Strings(restart)
+		logme.Warnf("configuration: these settings changed, but StreamDude must be restarted to apply them: %s\n",
+			strings.Join(restart, ", "))
+		status = "configuration reloaded; restart needed for " + strings.Join(restart, ", ")
+	}
+	logme.Infof("configuration reloaded from %q: %d settings changed, %d need a restart\n", configPath, len(changed), len(restart))
+}
+
+// applyConfigChanges reconfigures whatever depends on the settings that changed.
+func applyConfigChanges(changed map[string]bool) {
+	if changed["debug"] {
+		if debug.Get() {
+			logme.SetLevel(logrus.DebugLevel)
+		} else {
+			logme.SetLevel(logrus.InfoLevel)
+		}
+	}
+	if changed["mediapath"] || changed["mediaroots"] {
+		if err := configureMediaRoots(mediaRootsList.Get()); err != nil {
+			logme.Warnf("%s; /api/play will refuse all files\n", err)
+		}
+	}
+	mediaTypesChanged := changed["audioext"] || changed["videoext"] || changed["coverext"] || changed["covernames"]
+	if mediaTypesChanged {
+		configureMediaTypes()
+	}
+	if changed["ffprobe"] {
+		configureProbe()
+	}
+	if changed["mediapath"] || changed["watchdelay"] {
+		restartWatcher()
+	}
+	if changed["mediapath"] || mediaTypesChanged {
+		if err := library.StartRescan(mediaDirectory.Get()); err != nil {
+			logme.Errorf("could not rescan the library: %s\n", err)
+		}
+	}
+	if changed["streamer"] || changed["backend"] || changed["mediamtxurl"] || changed["rtmpurl"] || changed["srturl"] || changed["srtpassphrase"] ||
+		changed["icecasturl"] || changed["icecastmethod"] || changed["icecastformat"] {
+		if err := validateStreamers(); err != nil {
+			logme.Errorf("%s; streaming to that backend will fail\n", err)
+		}
+	}
+	// Profiles may have changed even if their path didn't.
+	if err := loadProfiles(profilesPath.Get()); err != nil {
+		logme.Errorf("%s; keeping the current profiles\n", err)
+	}
+}
+
+// monotonicUsec is the current time on the monotonic clock, as systemd wants it when reloading.
+func monotonicUsec() string {
+	var ts unix.Timespec
+	if err := unix.ClockGettime(unix.CLOCK_MONOTONIC, &ts); err != nil {
+		return "0"
+	}
+	return strconv.FormatInt(ts.Nano() / 1000, 10)
+}
@@ -0,0 +1,51 @@
+// Embedded on-disk database, shared by everything that needs persistent storage
+// (tokens, registered in-world objects, etc.).
+// We use bbolt, since it's pure Go and doesn't require an external server.
+//
+// © 2023 by Gwyneth Llewelyn. All rights reserved.
+// Licensed under a MIT License (see https://gwyneth-llewelyn.mit-license.org/).
+package main
+
+import (
+	"fmt"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Global handle to the embedded database; nil if it couldn't be opened.
+var db *bolt.DB
+
+// openDatabase opens (or creates) the bbolt database at `dbPath` and makes sure that
+// all the buckets we need exist.
+func openDatabase(dbPath string, buckets ...[]byte) (*bolt.DB, error) {
+	// Timeout avoids hanging forever if another StreamDude instance holds the lock.
+	boltDB, err := bolt.Open(dbPath, 0600, &bolt.Options{Timeout: 2 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("could not open database at %q: %w", dbPath, err)
+	}
+	err = boltDB.Update(func(tx *bolt.Tx) error {
+		for _, bucket := range buckets {
+			if _, err := tx.CreateBucketIfNotExists(bucket); err != nil {
+				return fmt.Errorf("could not create bucket %q: %w", bucket, err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		boltDB.Close()
+		return nil, err
+	}
+	return boltDB, nil
+}
+
+// closeDatabase flushes and closes the global database, if it's open.
+func closeDatabase() {
+	if db == nil {
+		return
+	}
+	if err := db.Close(); err != nil {
+		logme.Errorf("could not close database: %s\n", err)
+	}
+	db = nil
+}
@@ -0,0 +1,246 @@
+// Playlist player based on ffmpeg.
+// libVLC, if built in, is only used for audio (see vlc-streaming.go); playlists with videos are streamed
+// by ffmpeg instead, one supervised job (see jobs.go) per item, just like /api/play does.
+//
+// © 2023 by Gwyneth Llewelyn. All rights reserved.
+// Licensed under a MIT License (see https://gwyneth-llewelyn.mit-license.org/).
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+var errNotSupported = errors.New("not supported when streaming via ffmpeg")
+
+// ffmpegPlayer streams the items on a playlist, one after the other, via ffmpeg.
+type ffmpegPlayer struct {
+	mu sync.Mutex
+	items []PlayListItem	// checked items; nil when idle.
+	profile Profile			// transcoding profile for all items.
+	streamer Streamer		// where all items are streamed to.
+	track int				// index of the current item.
+	skipTo int				// item to play next, if the current one is interrupted by Next() or Previous(); -1 otherwise.
+	job *Job				// streaming the current item; nil between items.
+	started time.Time		// when the current item started.
+	trackChanges int		// track changes so far, i.e. items started, minus the first one.
+	stop chan struct{}		// closed to request the player to stop.
+	stopOnce sync.Once
+}
+
+// Global player for playlists with videos.
+var videoPlayer = newFFmpegPlayer()
+
+// newFFmpegPlayer returns an idle ffmpeg player.
+func newFFmpegPlayer() *ffmpegPlayer {
+	return &ffmpegPlayer{skipTo: -1}
+}
+
+// Play streams the checked items with the default transcoding profile, to the default backend.
+func (p *ffmpegPlayer) Play(items []PlayListItem) error {
+	profile, err := lookupProfile("")
+	if err != nil {
+		return err
+	}
+	streamer, err := lookupStreamer("")
+	if err != nil {
+		return err
+	}
+	return p.PlayProfile(items, profile, streamer)
+}
+
+// PlayProfile streams the checked items with the given transcoding profile, to the given
+// backend. It returns as soon as the first item starts.
+func (p *ffmpegPlayer) PlayProfile(items []PlayListItem, profile Profile, streamer Streamer) error {
+	var checked []PlayListItem
+	for _, item := range items {
+		if item.Checked() {
+			checked = append(checked, item)
+		}
+	}
+	if len(checked) == 0 {
+		return fmt.Errorf("ffmpeg player: no entries checked for streaming")
+	}
+	logme.Infof("ffmpeg player: %d/%d checked entries from playlist to be streamed\n", len(checked), len(items))
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.items != nil {
+		return errPlayerBusy
+	}
+	p.items, p.profile, p.streamer, p.track, p.skipTo = checked, profile, streamer, 0, -1
+	p.trackChanges, p.started = -1, time.Time{}
+	p.stop = make(chan struct{})
+	p.stopOnce = sync.Once{}
+	go p.run(p.stop)
+	return nil
+}
+
+// run streams one item after the other, until the end of the playlist or until stopped.
+func (p *ffmpegPlayer) run(stop chan struct{}) {
+	for {
+		p.mu.Lock()
+		if p.track >= len(p.items) {
+			logme.Infoln("ffmpeg player: playlist finished")
+			p.finish()
+			p.mu.Unlock()
+			return
+		}
+		item := p.items[p.track]
+		job, err := streamFile(item.Name(), p.profile, p.streamer)
+		if err != nil {
+			logme.Errorf("ffmpeg player: could not stream %q, skipping: %s\n", item.Name(), err)
+			p.track++
+			p.mu.Unlock()
+			continue
+		}
+		p.job, p.started = job, time.Now()
+		p.trackChanges++
+		p.mu.Unlock()
+
+		select {
+			case <-job.Done():
+			case <-stop:
+				logme.Infoln("ffmpeg player: stopped by request")
+				if err := job.Stop(jobStopGrace.Get()); err != nil && !errors.Is(err, errJobNotRunning) {
+					logme.Errorf("ffmpeg player: could not stop job %s: %s\n", job.ID(), err)
+				}
+				<-job.Done()
+				p.mu.Lock()
+				p.finish()
+				p.mu.Unlock()
+				return
+		}
+
+		p.mu.Lock()
+		p.job = nil
+		if p.skipTo >= 0 {
+			p.track, p.skipTo = p.skipTo, -1
+		} else {
+			p.track++
+		}
+		p.mu.Unlock()
+	}
+}
+
+// finish makes the player idle, closing the backend if it needs it (see streamers.go).
+// The lock must be held.
+func (p *ffmpegPlayer) finish() {
+	if closer, ok := p.streamer.(io.Closer); ok {
+		if err := closer.Close(); err != nil {
+			logme.Errorf("ffmpeg player: could not close %s: %s\n", p.streamer.Name(), err)
+		}
+	}
+	p.items, p.job, p.streamer = nil, nil, nil
+}
+
+// Stop requests the player to stop; the current job is stopped in the background.
+func (p *ffmpegPlayer) Stop() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.items == nil {
+		return errPlayerIdle
+	}
+	p.stopOnce.Do(func() { close(p.stop) })
+	return nil
+}
+
+// Next skips to the next item.
+func (p *ffmpegPlayer) Next() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.items == nil {
+		return errPlayerIdle
+	}
+	if p.track + 1 >= len(p.items) {
+		return fmt.Errorf("already on the last track")
+	}
+	return p.skip(p.track + 1)
+}
+
+// Previous goes back to the previous item (or restarts the first one).
+func (p *ffmpegPlayer) Previous() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.items == nil {
+		return errPlayerIdle
+	}
+	return p.skip(max(p.track - 1, 0))
+}
+
+// skip interrupts the current job, so that `track` is played next. Must be called with the lock held.
+func (p *ffmpegPlayer) skip(track int) error {
+	p.skipTo = track
+	if p.job == nil {
+		return nil
+	}
+	if err := p.job.Stop(jobStopGrace.Get()); err != nil && !errors.Is(err, errJobNotRunning) {
+		return err
+	}
+	return nil
+}
+
+// Pause is not possible: ffmpeg would lose the connection to the streamer.
+func (p *ffmpegPlayer) Pause() error {
+	return errNotSupported
+}
+
+// Resume is not possible, since pausing isn't.
+func (p *ffmpegPlayer) Resume() error {
+	return errNotSupported
+}
+
+// Seek is not possible while streaming in real time.
+func (p *ffmpegPlayer) Seek(position time.Duration) error {
+	return errNotSupported
+}
+
+// SetVolume is not possible without transcoding; use a profile instead.
+func (p *ffmpegPlayer) SetVolume(volume int) error {
+	return errNotSupported
+}
+
+// Status reports the current item and how far ffmpeg got.
+func (p *ffmpegPlayer) Status() PlayerStatus {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	status := PlayerStatus{Track: -1}
+	if p.items == nil {
+		return status
+	}
+	status.Active = true
+	status.Playing = p.job != nil
+	status.Tracks = len(p.items)
+	status.Volume = 100
+	if p.track < len(p.items) {
+		status.Track = p.track
+		status.File = p.items[p.track].Name()
+		status.Length = p.items[p.track].Duration().Milliseconds()
+	}
+	status.HLS = hlsAddress(p.streamer)
+	if p.job != nil {
+		status.Job = p.job.ID()
+		if progress := p.job.Status().Progress; progress != nil {
+			status.Position = int64(progress.OutTime * 1000)
+		}
+	}
+	status.TrackChanges = max(p.trackChanges, 0)
+	if !p.started.IsZero() {
+		started := p.started
+		status.TrackStarted = &started
+	}
+	return status
+}
+
+// hasVideo checks if any of the checked items is a video.
+func hasVideo(items []PlayListItem) bool {
+	for _, item := range items {
+		if item.Checked() && item.IsVideo() {
+			return true
+		}
+	}
+	return false
+}
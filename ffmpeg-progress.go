@@ -0,0 +1,153 @@
+// Parser for the key=value stream that ffmpeg writes when launched with `-progress`.
+// Each job keeps the latest snapshot, and a watchdog warns when ffmpeg stalls.
+//
+// © 2023 by Gwyneth Llewelyn. All rights reserved.
+// Licensed under a MIT License (see https://gwyneth-llewelyn.mit-license.org/).
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Below this speed (where 1.0 means real time), ffmpeg is considered to be stalling.
+const jobStallSpeed = 0.05
+
+// jobStallAfter is how long ffmpeg may stall before we warn about it (zero disables warnings).
+var jobStallAfter setting[time.Duration]
+
+// JobProgress is the latest progress report sent by ffmpeg.
+// Fields that ffmpeg reports as N/A are left at zero.
+type JobProgress struct {
+	Frame int64				`json:"frame" xml:"frame"`
+	FPS float64				`json:"fps" xml:"fps"`
+	Bitrate float64			`json:"bitrate" xml:"bitrate"`				// in kbit/s.
+	OutTime float64			`json:"outTime" xml:"outTime"`				// position on the output, in seconds.
+	Speed float64			`json:"speed" xml:"speed"`					// 1.0 means real time.
+	DroppedFrames int64		`json:"droppedFrames" xml:"droppedFrames"`
+	DuplicatedFrames int64	`json:"duplicatedFrames" xml:"duplicatedFrames"`
+	TotalSize int64			`json:"totalSize" xml:"totalSize"`			// bytes written so far.
+	Finished bool			`json:"finished" xml:"finished"`			// ffmpeg sent its last report.
+	Updated time.Time		`json:"updated" xml:"updated"`				// when this report arrived.
+	Stalled bool			`json:"stalled" xml:"stalled"`				// set by the watchdog.
+}
+
+// String is mostly used for plain-text replies.
+func (p JobProgress) String() string {
+	return fmt.Sprintf("frame=%d fps=%.1f bitrate=%.1fkbit/s time=%s speed=%.2fx dropped=%d",
+		p.Frame, p.FPS, p.Bitrate, time.Duration(p.OutTime * float64(time.Second)).Round(time.Millisecond),
+		p.Speed, p.DroppedFrames)
+}
+
+// set updates a single field from a key=value pair, ignoring unknown keys and N/A values.
+func (p *JobProgress) set(key, value string) {
+	value = strings.TrimSpace(value)
+	if value == "" || value == "N/A" {
+		return
+	}
+	switch key {
+		case "frame":
+			p.Frame, _ = strconv.ParseInt(value, 10, 64)
+		case "fps":
+			p.FPS, _ = strconv.ParseFloat(value, 64)
+		case "bitrate":
+			p.Bitrate, _ = strconv.ParseFloat(strings.TrimSuffix(value, "kbits/s"), 64)
+		case "out_time_us":
+			if us, err := strconv.ParseInt(value, 10, 64); err == nil {
+				p.OutTime = float64(us) / 1e6
+			}
+		case "speed":
+			p.Speed, _ = strconv.ParseFloat(strings.TrimSuffix(value, "x"), 64)
+		case "drop_frames":
+			p.DroppedFrames, _ = strconv.ParseInt(value, 10, 64)
+		case "dup_frames":
+			p.DuplicatedFrames, _ = strconv.ParseInt(value, 10, 64)
+		case "total_size":
+			p.TotalSize, _ = strconv.ParseInt(value, 10, 64)
+	}
+}
+
+// collectProgress reads the output of `-progress pipe:1` until EOF.
+// ffmpeg sends blocks of key=value lines, each terminated by `progress=continue`
+// (or `progress=end`, for the last one), so we only publish complete blocks.
+func (j *Job) collectProgress(r io.Reader) {
+	scanner := bufio.NewScanner(r)
+	var pending JobProgress
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(strings.TrimSpace(scanner.Text()), "=")
+		if !ok {
+			continue
+		}
+		if key != "progress" {
+			pending.set(key, value)
+			continue
+		}
+		pending.Finished = value == "end"
+		pending.Updated = time.Now()
+		j.setProgress(pending)
+	}
+}
+
+// setProgress publishes a new progress report, keeping track of when ffmpeg started to slow down.
+func (j *Job) setProgress(p JobProgress) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if p.Speed < jobStallSpeed && p.OutTime > 0 {
+		if j.slowSince.IsZero() {
+			j.slowSince = p.Updated
+		}
+	} else {
+		j.slowSince = time.Time{}
+	}
+	p.Stalled = j.progress.Stalled && !p.Finished
+	j.progress = p
+}
+
+// watchProgress periodically checks if ffmpeg has stalled, i.e. either it has been running
+// below jobStallSpeed, or it hasn't reported anything, for longer than `after`.
+// Warnings are logged only once per stall. Returns when the job ends.
+// Only jobs sending progress reports may be watched: any others would always seem stalled.
+func (j *Job) watchProgress(after time.Duration) {
+	if after <= 0 {
+		return
+	}
+	ticker := time.NewTicker(max(after / 4, time.Second))
+	defer ticker.Stop()
+	for {
+		select {
+			case <-j.done:
+				return
+			case <-ticker.C:
+		}
+		j.mu.Lock()
+		if j.state != JobRunning {
+			j.mu.Unlock()
+			continue
+		}
+		lastReport := j.progress.Updated
+		if lastReport.IsZero() {
+			lastReport = j.started
+		}
+		var reason string
+		switch {
+			case time.Since(lastReport) > after:
+				reason = fmt.Sprintf("no progress reported for %v", time.Since(lastReport).Round(time.Second))
+			case !j.slowSince.IsZero() && time.Since(j.slowSince) > after:
+				reason = fmt.Sprintf("speed has been %.2fx for %v", j.progress.Speed, time.Since(j.slowSince).Round(time.Second))
+		}
+		wasStalled := j.progress.Stalled
+		j.progress.Stalled = reason != ""
+		j.mu.Unlock()
+
+		switch {
+			case reason != "" && !wasStalled:
+				logme.Warnf("⚠️ job %s (%s) is stalling: %s\n", j.id, j.source, reason)
+			case reason == "" && wasStalled:
+				logme.Infof("job %s (%s) has recovered from a stall\n", j.id, j.source)
+		}
+	}
+}
@@ -190,7 +190,7 @@ func expandPath(path string) (string, error) {
 	}
 
 	// we have two cases. The simplest one is the current user:
-	if path[1] == '/' {
+	if len(path) == 1 || path[1] == '/' {
 		usr, err := user.Current()
 		if err != nil {
 			return "", err
@@ -206,6 +206,24 @@ func expandPath(path string) (string, error) {
 	return filepath.Join(usr.HomeDir, restOfPath), nil
 }
 
+// insideDirectory checks if `path` is `dir` itself or somewhere below it.
+// Both are made absolute and cleaned up first, but symlinks are not resolved.
+func insideDirectory(dir string, path string) bool {
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		return false
+	}
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return false
+	}
+	rel, err := filepath.Rel(absDir, absPath)
+	if err != nil {
+		return false
+	}
+	return rel != ".." && !strings.HasPrefix(rel, ".." + string(filepath.Separator))
+}
+
 /**
 *	Cryptographic helper functions.
 **/
@@ -258,6 +276,16 @@ func formatAsDate(t time.Time) string {
 	return fmt.Sprintf("%d/%02d/%02d", year, month, day)
 }
 
+// formatDuration shows a duration as [h:]mm:ss, for templates.
+func formatDuration(d time.Duration) string {
+	d = d.Round(time.Second)
+	hours, minutes, seconds := int(d.Hours()), int(d.Minutes()) % 60, int(d.Seconds()) % 60
+	if hours > 0 {
+		return fmt.Sprintf("%d:%02d:%02d", hours, minutes, seconds)
+	}
+	return fmt.Sprintf("%02d:%02d", minutes, seconds)
+}
+
 // formatAsYear is another function for the templating system.
 func formatAsYear(t time.Time) string {
 	year, _, _ := t.Date()
@@ -315,8 +343,10 @@ func environment(c *gin.Context, env gin.H) gin.H {
 	// }
 
 	// Check if we have a (configured) frontend, and, if so, adjust templates.
+	// (the port is a copy: the setting itself must not change under a configuration reload)
+	tplPort := serverPort
 	if frontEnd == "nginx" {
-		serverPort = externalPort	// should also be fine if it's empty!
+		tplPort = externalPort	// should also be fine if it's empty!
 		if externalHost == "" || externalHost == "127.0.0.1" || externalHost == "[::1]" || externalHost == "localhost" {
 			tplHost = "localhost"
 		} else {
@@ -330,10 +360,10 @@ func environment(c *gin.Context, env gin.H) gin.H {
 		"now"			: formatAsYear(time.Now()),
 		"titleCommon"	: "StreamDude",
 		"description"	: "",	// No description by default; this will be shown on the header title.
-		"LSLSignaturePIN" :  lslSignaturePIN,
+		"LSLSignaturePIN" :  lslSignaturePIN.Get(),
 		"URLPathPrefix"	: urlPathPrefix,
 		"Host"			: template.URL(tplHost),			// this gets adjusted depending on having a reverse proxy or not, (gwyneth 20220112)
-		"ServerPort"	: template.URL(serverPort),		//  template.URL() allows hostnames/ports not to be parsed
+		"ServerPort"	: template.URL(tplPort),		//  template.URL() allows hostnames/ports not to be parsed
 //		"scheme"		: template.URL(scheme),			// either http:// or https://; see above. (gwyneth 20220320)
 
 		/* session data — not implemented yet! (gwyneth 20220112) */
@@ -367,6 +397,24 @@ func obfuscate(s string) string {
 	return slice
 }
 
+// obfuscateURL hides any query parameters (which may carry secrets) and passwords from a URL,
+// so that it can be safely logged or shown.
+func obfuscateURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return obfuscate(rawURL)
+	}
+	if u.RawQuery != "" {
+		u.RawQuery = "********"
+	}
+	if _, hasPassword := u.User.Password(); hasPassword {
+		// the asterisks would be escaped, if set as the password.
+		u.User = url.UserPassword(u.User.Username(), "")
+		return strings.Replace(u.String(), ":@", ":********@", 1)
+	}
+	return u.String()
+}
+
 // ISO-3166-1 two-letter country codes to-emoji.
 func getFlag(countryCode string) string {
 	// 0x1F1E6 - REGIONAL INDICATOR SYMBOL LETTER A
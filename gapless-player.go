@@ -0,0 +1,555 @@
+// Gapless playlist player.
+// libVLC needs cgo and an audio output on the host, and the ffmpeg player (ffmpeg-player.go)
+// starts a new stream for every track, which listeners hear as a gap, or worse, a dropped
+// connection. This player decodes each track to raw PCM with its own ffmpeg, mixes them in
+// Go (crossfading, or adding a gap, between tracks), and feeds the result to a single ffmpeg
+// encoder, which is one uninterrupted stream for the whole playlist. Audio only.
+//
+// © 2023 by Gwyneth Llewelyn. All rights reserved.
+// Licensed under a MIT License (see https://gwyneth-llewelyn.mit-license.org/).
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	gaplessMode setting[bool]	// if set, audio playlists are streamed by the gapless player by default.
+	crossfade setting[time.Duration]	// how long tracks overlap, fading from one to the next; 0 for none.
+	trackGap setting[time.Duration]	// silence between tracks, when not crossfading.
+)
+
+// Format of the samples going from the decoders to the encoder: signed 16-bit little-endian,
+// interleaved stereo, 44.1 kHz, which is what pretty much every audio codec takes.
+const (
+	gaplessRate		= 44100
+	gaplessChannels	= 2
+	gaplessFrame	= 2 * gaplessChannels			// bytes per frame (one sample per channel).
+	gaplessChunk	= 4096 * gaplessFrame			// bytes read from the decoders at a time.
+)
+
+// gaplessInput is how the encoder reads the samples, from its standard input; -re keeps it
+// (and thus everything upstream) going in real time.
+var gaplessInput = []string{"-re", "-f", "s16le", "-ar", strconv.Itoa(gaplessRate), "-ac", strconv.Itoa(gaplessChannels), "-i", "pipe:0"}
+
+// gaplessPlayer streams the items on a playlist as one continuous audio stream.
+type gaplessPlayer struct {
+	mu sync.Mutex
+	items []PlayListItem				// checked items; nil when idle.
+	streamer Streamer					// where the stream goes.
+	track int							// index of the current item.
+	skipTo int							// item to play next, if the current one is interrupted by Next() or Previous(); -1 otherwise.
+	volume int							// in percent, applied to the samples.
+	started time.Time					// when the current item started.
+	offset time.Duration				// where the decoder of the current item started from (see Seek).
+	decoding time.Time					// when it did, moved forward by the time spent paused.
+	pausedAt time.Time					// when the player was paused; zero if it's playing.
+	seekTo time.Duration				// where to restart the current item from, if interrupted by Seek(); -1 otherwise.
+	trackChanges int					// track changes so far, i.e. items started, minus the first one.
+	job *Job							// the encoder; nil when idle.
+	cancelTrack context.CancelFunc		// stops the decoder of the current item.
+	stop chan struct{}					// closed to request the player to stop.
+	stopOnce sync.Once
+}
+
+// Global player for gapless streaming.
+var continuousPlayer = newGaplessPlayer()
+
+// newGaplessPlayer returns an idle gapless player.
+func newGaplessPlayer() *gaplessPlayer {
+	return &gaplessPlayer{skipTo: -1, seekTo: -1, volume: 100}
+}
+
+// Play streams the checked items with the default transcoding profile, to the default backend.
+func (p *gaplessPlayer) Play(items []PlayListItem) error {
+	profile, err := lookupProfile("")
+	if err != nil {
+		return err
+	}
+	streamer, err := lookupStreamer("")
+	if err != nil {
+		return err
+	}
+	return p.PlayProfile(items, profile, streamer)
+}
+
+// PlayProfile streams the checked items, encoded as set by the profile (its video settings
+// are ignored), to the given backend. It returns as soon as the encoder starts.
+func (p *gaplessPlayer) PlayProfile(items []PlayListItem, profile Profile, streamer Streamer) error {
+	var checked []PlayListItem
+	for _, item := range items {
+		if item.Checked() {
+			checked = append(checked, item)
+		}
+	}
+	if len(checked) == 0 {
+		return fmt.Errorf("gapless player: no entries checked for streaming")
+	}
+	logme.Infof("gapless player: %d/%d checked entries from playlist to be streamed\n", len(checked), len(items))
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.items != nil {
+		return errPlayerBusy
+	}
+	// the stream is published under the name of the first track; see streamers.go.
+	job, stdin, err := streamInput(checked[0].Name(), gaplessInput, gaplessEncoding(profile), streamer, true)
+	if err != nil {
+		if closer, ok := streamer.(io.Closer); ok {
+			closer.Close()
+		}
+		return err
+	}
+	p.items, p.streamer, p.job, p.track, p.skipTo, p.seekTo = checked, streamer, job, 0, -1, -1
+	p.trackChanges, p.started, p.pausedAt = -1, time.Time{}, time.Time{}
+	p.stop = make(chan struct{})
+	p.stopOnce = sync.Once{}
+	go p.run(p.stop, job, stdin)
+	return nil
+}
+
+// gaplessEncoding is the profile without anything about video, since there is none; the
+// samples must always be encoded, so "copy" means the default audio codec.
+func gaplessEncoding(profile Profile) []string {
+	profile.VideoCodec, profile.VideoBitrate, profile.Scale = "none", "", ""
+	profile.KeyframeInterval, profile.Preset, profile.Tune = 0, "", ""
+	if profile.AudioCodec == "" || profile.AudioCodec == "copy" || profile.AudioCodec == "none" {
+		profile.AudioCodec = "aac"
+	}
+	return profile.args()
+}
+
+// run decodes one item after the other into the encoder, until the end of the playlist,
+// until stopped, or until the encoder fails.
+func (p *gaplessPlayer) run(stop chan struct{}, job *Job, encoder io.WriteCloser) {
+	var (
+		tail []byte		// end of the previous item, held back to be crossfaded with the next one.
+		first = true
+		seek time.Duration = -1	// restarting the same item, from there.
+		stopped bool
+		err error
+	)
+	for !stopped && err == nil {
+		p.mu.Lock()
+		if p.track >= len(p.items) {
+			p.mu.Unlock()
+			logme.Infoln("gapless player: playlist finished")
+			break
+		}
+		item, track := p.items[p.track], p.track
+		ctx, cancel := context.WithCancel(context.Background())
+		p.cancelTrack = cancel
+		p.mu.Unlock()
+
+		// both can be changed while streaming.
+		fade := bytesFor(crossfade.Get())
+		if fade == 0 && len(tail) > 0 {
+			_, err = encoder.Write(tail)
+			tail = nil
+		}
+		if err == nil && !first && seek < 0 && fade == 0 && trackGap.Get() > 0 {
+			err = writeSilence(encoder, bytesFor(trackGap.Get()), stop)
+		}
+		if err != nil {
+			cancel()
+			break
+		}
+		first = false
+
+		var stderr bytes.Buffer
+		args := []string{"-nostdin", "-nostats", "-loglevel", "error"}
+		if seek > 0 {
+			args = append(args, "-ss", strconv.FormatFloat(seek.Seconds(), 'f', 3, 64))
+		}
+		args = append(args, "-i", item.Name(), "-vn", "-f", "s16le", "-ar", strconv.Itoa(gaplessRate), "-ac", strconv.Itoa(gaplessChannels), "pipe:1")
+		decoder := exec.CommandContext(ctx, ffmpegPath.Get(), args...)
+		decoder.Stderr = &stderr
+		samples, perr := decoder.StdoutPipe()
+		if perr == nil {
+			perr = decoder.Start()
+		}
+		if perr != nil {
+			logme.Errorf("gapless player: could not decode %q, skipping: %s\n", item.Name(), perr)
+		} else {
+			// a track that can't be decoded after all is no change at all.
+			started := func() { p.trackChanged(item, track) }
+			if position := seek; position >= 0 {
+				started = func() { p.sought(position) }
+			}
+			tail, err = p.mix(ctx, samples, tail, fade, encoder, stop, started)
+			interrupted := ctx.Err() != nil
+			cancel()	// if stopped, the decoder might still be going.
+			if werr := decoder.Wait(); werr != nil && !interrupted {
+				logme.Errorf("gapless player: decoding %q failed: %s (%s)\n", item.Name(), werr, strings.TrimSpace(stderr.String()))
+			}
+		}
+		cancel()
+
+		select {
+			case <-stop:
+				logme.Infoln("gapless player: stopped by request")
+				stopped = true
+			default:
+		}
+		p.mu.Lock()
+		seek = -1
+		switch {
+			case p.skipTo >= 0:
+				p.track, p.skipTo = p.skipTo, -1
+			case p.seekTo >= 0 && perr == nil:
+				seek = p.seekTo
+			default:
+				p.track++
+		}
+		p.seekTo = -1
+		p.mu.Unlock()
+	}
+	if err != nil {
+		logme.Errorf("gapless player: encoder job %s failed: %s\n", job.ID(), err)
+	} else if !stopped && len(tail) > 0 {
+		encoder.Write(tail)
+	}
+
+	// Without more samples, the encoder finishes what it has, and exits.
+	encoder.Close()
+	select {
+		case <-job.Done():
+		case <-time.After(jobStopGrace.Get()):
+			if err := job.Stop(jobStopGrace.Get()); err != nil && !errors.Is(err, errJobNotRunning) {
+				logme.Errorf("gapless player: could not stop job %s: %s\n", job.ID(), err)
+			}
+			<-job.Done()
+	}
+	p.mu.Lock()
+	p.finish()
+	p.mu.Unlock()
+}
+
+// mix copies the samples of an item to the encoder, crossfading its start with `tail` (the
+// end of the previous item), and returns its own last `fade` bytes, to be crossfaded with
+// the next one; `started` is called as soon as the first samples are decoded, if any ever
+// are. It returns early if the player is stopped. While paused, it writes silence instead,
+// so that the encoder keeps its connection to the backend, unless the item gets interrupted
+// (i.e. `ctx` is cancelled).
+func (p *gaplessPlayer) mix(ctx context.Context, samples io.Reader, tail []byte, fade int, encoder io.Writer, stop chan struct{}, started func()) ([]byte, error) {
+	decoded := func(n int) {
+		if n > 0 && started != nil {
+			started()
+			started = nil
+		}
+	}
+	if len(tail) > 0 {
+		head := make([]byte, len(tail))
+		n, _ := io.ReadFull(samples, head)
+		head = head[:n - n % gaplessFrame]
+		decoded(len(head))
+		p.applyVolume(head)
+		crossfadeSamples(tail, head)
+		if _, err := encoder.Write(tail); err != nil {
+			return nil, err
+		}
+	}
+	buf := make([]byte, gaplessChunk)
+	held := make([]byte, 0, fade + gaplessChunk)
+	for {
+		select {
+			case <-stop:
+				return nil, nil
+			default:
+		}
+		n, err := io.ReadFull(samples, buf)
+		n -= n % gaplessFrame
+		decoded(n)
+		for p.paused() && ctx.Err() == nil {
+			select {
+				case <-stop:
+					return nil, nil
+				default:
+			}
+			if werr := writeSilence(encoder, gaplessChunk, stop); werr != nil {
+				return nil, werr
+			}
+		}
+		if n > 0 {
+			p.applyVolume(buf[:n])
+			held = append(held, buf[:n]...)
+			if over := len(held) - fade; over > 0 {
+				if _, werr := encoder.Write(held[:over]); werr != nil {
+					return nil, werr
+				}
+				held = append(held[:0], held[over:]...)
+			}
+		}
+		if err != nil {
+			return held, nil	// end of the item, or the decoder was stopped.
+		}
+	}
+}
+
+// trackChanged is the track-change event, fired at each boundary, as soon as the first
+// samples of the new item are decoded (i.e. at the start of the crossfade, if any), so
+// that items that fail to decode don't count: the status moves on to it, counting
+// the change (so that clients polling it notice), and backends that can show a title to
+// listeners (e.g. Icecast) get its title.
+func (p *gaplessPlayer) trackChanged(item PlayListItem, track int) {
+	p.mu.Lock()
+	p.track, p.started = track, time.Now()
+	p.offset, p.decoding = 0, p.started
+	if !p.pausedAt.IsZero() {
+		p.pausedAt = p.started
+	}
+	p.trackChanges++
+	streamer, tracks := p.streamer, len(p.items)
+	p.mu.Unlock()
+
+	title := streamTitle(item.Name())
+	logme.Infof("gapless player: now playing %d/%d, %q\n", track + 1, tracks, title)
+	if titled, ok := streamer.(titleStreamer); ok {
+		// not worth holding back the samples for it.
+		go func() {
+			if err := titled.SetTitle(title); err != nil {
+				logme.Warnf("gapless player: could not update the title on %s: %s\n", streamer.Name(), err)
+			}
+		}()
+	}
+}
+
+// sought is called when the current item restarts from `position`, after Seek().
+func (p *gaplessPlayer) sought(position time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.offset, p.decoding = position, time.Now()
+	if !p.pausedAt.IsZero() {
+		p.pausedAt = p.decoding
+	}
+	logme.Infof("gapless player: %q restarted at %v\n", p.items[p.track].Name(), position)
+}
+
+// paused checks if the player is paused.
+func (p *gaplessPlayer) paused() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return !p.pausedAt.IsZero()
+}
+
+// finish makes the player idle, closing the backend if it needs it. The lock must be held.
+func (p *gaplessPlayer) finish() {
+	if closer, ok := p.streamer.(io.Closer); ok {
+		if err := closer.Close(); err != nil {
+			logme.Errorf("gapless player: could not close %s: %s\n", p.streamer.Name(), err)
+		}
+	}
+	p.items, p.job, p.streamer, p.cancelTrack = nil, nil, nil, nil
+}
+
+// Stop requests the player to stop; the encoder is stopped in the background.
+func (p *gaplessPlayer) Stop() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.items == nil {
+		return errPlayerIdle
+	}
+	p.stopOnce.Do(func() { close(p.stop) })
+	if p.cancelTrack != nil {
+		p.cancelTrack()
+	}
+	return nil
+}
+
+// Next skips to the next item; it's crossfaded in, as usual.
+func (p *gaplessPlayer) Next() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.items == nil {
+		return errPlayerIdle
+	}
+	if p.track + 1 >= len(p.items) {
+		return fmt.Errorf("already on the last track")
+	}
+	return p.skip(p.track + 1)
+}
+
+// Previous goes back to the previous item (or restarts the first one).
+func (p *gaplessPlayer) Previous() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.items == nil {
+		return errPlayerIdle
+	}
+	return p.skip(max(p.track - 1, 0))
+}
+
+// skip stops decoding the current item, so that `track` is played next. Must be called with the lock held.
+func (p *gaplessPlayer) skip(track int) error {
+	p.skipTo = track
+	if p.cancelTrack != nil {
+		p.cancelTrack()
+	}
+	return nil
+}
+
+// Pause stops decoding, and streams silence until resumed.
+func (p *gaplessPlayer) Pause() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.items == nil {
+		return errPlayerIdle
+	}
+	if p.pausedAt.IsZero() {
+		p.pausedAt = time.Now()
+	}
+	return nil
+}
+
+// Resume goes back to decoding where it was paused.
+func (p *gaplessPlayer) Resume() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.items == nil {
+		return errPlayerIdle
+	}
+	if !p.pausedAt.IsZero() {
+		p.decoding = p.decoding.Add(time.Since(p.pausedAt))
+		p.pausedAt = time.Time{}
+	}
+	return nil
+}
+
+// Seek restarts decoding the current item from `position`; it's crossfaded in, as usual.
+func (p *gaplessPlayer) Seek(position time.Duration) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.items == nil || p.track >= len(p.items) {
+		return errPlayerIdle
+	}
+	if length := p.items[p.track].Duration(); length > 0 && position >= length {
+		return fmt.Errorf("position %v is beyond the end of the track (%v)", position, length)
+	}
+	p.seekTo = position
+	if p.cancelTrack != nil {
+		p.cancelTrack()
+	}
+	return nil
+}
+
+// SetVolume changes the volume from now on (well, after the crossfade that is under way).
+func (p *gaplessPlayer) SetVolume(volume int) error {
+	if volume < 0 || volume > 200 {
+		return fmt.Errorf("invalid volume %d (expected 0-200)", volume)
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.items == nil {
+		return errPlayerIdle
+	}
+	p.volume = volume
+	return nil
+}
+
+// Status reports the current item, and for how long it has been playing.
+func (p *gaplessPlayer) Status() PlayerStatus {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	status := PlayerStatus{Track: -1}
+	if p.items == nil {
+		return status
+	}
+	status.Active = true
+	status.Playing = p.job != nil && p.pausedAt.IsZero()
+	status.Tracks = len(p.items)
+	status.Volume = p.volume
+	if p.track < len(p.items) {
+		status.Track = p.track
+		status.File = p.items[p.track].Name()
+		status.Length = p.items[p.track].Duration().Milliseconds()
+	}
+	if !p.started.IsZero() {
+		until := time.Now()
+		if !p.pausedAt.IsZero() {
+			until = p.pausedAt
+		}
+		status.Position = (p.offset + until.Sub(p.decoding)).Milliseconds()
+		started := p.started
+		status.TrackStarted = &started
+	}
+	status.TrackChanges = max(p.trackChanges, 0)
+	if p.job != nil {
+		status.Job = p.job.ID()	// the same for the whole playlist.
+	}
+	status.HLS = hlsAddress(p.streamer)
+	return status
+}
+
+// applyVolume scales the samples in place.
+func (p *gaplessPlayer) applyVolume(samples []byte) {
+	p.mu.Lock()
+	volume := p.volume
+	p.mu.Unlock()
+	if volume == 100 {
+		return
+	}
+	for i := 0; i + 1 < len(samples); i += 2 {
+		sample := float64(int16(binary.LittleEndian.Uint16(samples[i:]))) * float64(volume) / 100
+		binary.LittleEndian.PutUint16(samples[i:], uint16(clampSample(sample)))
+	}
+}
+
+// crossfadeSamples fades `out` out, and `in` (which may be shorter) in, mixing them into `out`.
+func crossfadeSamples(out, in []byte) {
+	frames := len(out) / gaplessFrame
+	for i := 0; i + 1 < len(out); i += 2 {
+		fadeIn := float64(i / gaplessFrame) / float64(frames)
+		sample := float64(int16(binary.LittleEndian.Uint16(out[i:]))) * (1 - fadeIn)
+		if i + 1 < len(in) {
+			sample += float64(int16(binary.LittleEndian.Uint16(in[i:]))) * fadeIn
+		}
+		binary.LittleEndian.PutUint16(out[i:], uint16(clampSample(sample)))
+	}
+}
+
+// clampSample keeps mixed samples within range, rather than letting them wrap around.
+func clampSample(sample float64) int16 {
+	switch {
+		case sample > 32767:
+			return 32767
+		case sample < -32768:
+			return -32768
+	}
+	return int16(sample)
+}
+
+// bytesFor is how many bytes of samples last for `d`, in whole frames.
+func bytesFor(d time.Duration) int {
+	if d <= 0 {
+		return 0
+	}
+	return int(d.Seconds() * gaplessRate) * gaplessFrame
+}
+
+// writeSilence writes `n` bytes of silence, a chunk at a time, so that it can be stopped.
+func writeSilence(w io.Writer, n int, stop chan struct{}) error {
+	silence := make([]byte, gaplessChunk)
+	for n > 0 {
+		select {
+			case <-stop:
+				return nil
+			default:
+		}
+		chunk := silence[:min(n, len(silence))]
+		if _, err := w.Write(chunk); err != nil {
+			return err
+		}
+		n -= len(chunk)
+	}
+	return nil
+}
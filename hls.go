@@ -0,0 +1,272 @@
+// HLS output.
+// Not everybody can play RTSP, but every browser can play HLS (with a little help), so
+// StreamDude can also have ffmpeg write HLS segments and a rolling playlist to a directory
+// of its own, one per stream, and serve them at /hls/<stream>/index.m3u8. Old segments are
+// deleted as new ones come in, and the whole directory goes away when the stream ends, be
+// it a single file or a whole playlist.
+//
+// © 2023 by Gwyneth Llewelyn. All rights reserved.
+// Licensed under a MIT License (see https://gwyneth-llewelyn.mit-license.org/).
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/dchest/uniuri"
+	"github.com/gin-gonic/gin"
+)
+
+var (
+	hlsDirectory string			// where HLS directories go, as set on the command line; empty for a temporary one.
+	hlsSegment setting[time.Duration]	// target duration of each segment.
+	hlsWindow setting[time.Duration]	// how far back the playlist goes; older segments are deleted.
+
+	hlsRoot string				// actual directory, see configureHLS.
+	hlsTemporary bool			// if set, hlsRoot is removed on shutdown.
+)
+
+// Names of the files written by ffmpeg; nothing else is served.
+const hlsPlaylist = "index.m3u8"
+
+var hlsSegmentName = regexp.MustCompile(`^segment[0-9]+\.ts$`)
+
+// hlsStreams maps stream IDs to their HLS directories.
+var hlsStreams = struct {
+	sync.RWMutex
+	dirs map[string]string
+}{dirs: make(map[string]string)}
+
+// configureHLS sets up the directory for HLS output. If none was set, a temporary one is
+// created; otherwise, whatever was left there by a previous run is removed.
+func configureHLS() error {
+	if hlsDirectory == "" {
+		dir, err := os.MkdirTemp("", "streamdude-hls-")
+		if err != nil {
+			return fmt.Errorf("could not create a temporary directory for HLS: %w", err)
+		}
+		hlsRoot, hlsTemporary = dir, true
+		logme.Debugf("HLS output goes to %q\n", hlsRoot)
+		return nil
+	}
+	dir, err := expandPath(hlsDirectory)
+	if err != nil {
+		return err
+	}
+	if dir, err = filepath.Abs(dir); err != nil {
+		return err
+	}
+	if err = os.MkdirAll(dir, 0750); err != nil {
+		return fmt.Errorf("could not create HLS directory: %w", err)
+	}
+	stale, _ := filepath.Glob(filepath.Join(dir, "stream-*"))
+	for _, leftover := range stale {
+		if err = os.RemoveAll(leftover); err != nil {
+			logme.Warnf("could not remove stale HLS directory %q: %s\n", leftover, err)
+		}
+	}
+	hlsRoot = dir
+	logme.Debugf("HLS output goes to %q (%d stale directories removed)\n", hlsRoot, len(stale))
+	return nil
+}
+
+// removeHLSDirectory cleans up on shutdown, when no more jobs are running.
+func removeHLSDirectory() {
+	if hlsRoot == "" {
+		return
+	}
+	target := hlsRoot
+	if !hlsTemporary {
+		target = filepath.Join(hlsRoot, "stream-*")
+	}
+	matches, _ := filepath.Glob(target)
+	for _, dir := range matches {
+		if err := os.RemoveAll(dir); err != nil {
+			logme.Warnf("could not remove HLS directory %q: %s\n", dir, err)
+		}
+	}
+}
+
+// hlsURL is where the playlist of a stream is served.
+func hlsURL(streamID string) string {
+	return path.Join(urlPathPrefix, "hls", streamID, hlsPlaylist)
+}
+
+// hlsStreamer has ffmpeg write HLS to a directory of its own, which is served from the
+// first file published until the streamer is closed, when it's removed. Every file
+// published in between is appended to the same playlist, so that a whole playlist of
+// files (one job each, see ffmpeg-player.go) can be watched without changing URLs.
+type hlsStreamer struct {
+	id string			// identifies the stream on its URL.
+	mu sync.Mutex
+	dir string			// where the files go; empty until something is published.
+	done chan struct{}	// closed when the streamer is.
+}
+
+// newHLSStreamer returns a streamer for a new HLS stream.
+func newHLSStreamer() *hlsStreamer {
+	return &hlsStreamer{id: uniuri.NewLen(12), done: make(chan struct{})}
+}
+
+func (s *hlsStreamer) Name() string {
+	return "hls"
+}
+
+// URL is where viewers can watch the stream.
+func (s *hlsStreamer) URL() string {
+	return hlsURL(s.id)
+}
+
+// Publish creates the directory, the first time, and starts serving it.
+// Later files are appended to the same playlist, with a discontinuity between them.
+func (s *hlsStreamer) Publish(filename string) (string, []string, error) {
+	segment, window := hlsSegment.Get(), hlsWindow.Get()
+	if segment <= 0 || window < segment {
+		return "", nil, fmt.Errorf("invalid HLS segment duration (%v) or window (%v)", segment, window)
+	}
+	listSize := int(window / segment)
+	dir := filepath.Join(hlsRoot, "stream-new")
+	if filename != "" {
+		var err error
+		if dir, err = s.directory(); err != nil {
+			return "", nil, err
+		}
+	}
+	args := []string{"-f", "hls",
+		"-hls_time", strconv.FormatFloat(segment.Seconds(), 'f', -1, 64),
+		"-hls_list_size", strconv.Itoa(listSize),
+		"-hls_delete_threshold", "1",
+		"-hls_flags", "delete_segments+independent_segments+temp_file+append_list+omit_endlist+discont_start",
+		"-hls_segment_filename", filepath.Join(dir, "segment%05d.ts")}
+	return filepath.Join(dir, hlsPlaylist), args, nil
+}
+
+func (s *hlsStreamer) Redact(target string) string {
+	return target	// just a local file.
+}
+
+// directory returns the directory of the stream, creating it if needed.
+func (s *hlsStreamer) directory() (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	select {
+		case <-s.done:
+			return "", fmt.Errorf("HLS stream %s already closed", s.id)
+		default:
+	}
+	if s.dir != "" {
+		return s.dir, nil
+	}
+	dir, err := os.MkdirTemp(hlsRoot, "stream-")
+	if err != nil {
+		return "", fmt.Errorf("could not create HLS directory: %w", err)
+	}
+	s.dir = dir
+	hlsStreams.Lock()
+	hlsStreams.dirs[s.id] = dir
+	hlsStreams.Unlock()
+	logme.Infof("HLS available at %s\n", s.URL())
+
+	go func() {
+		// ffmpeg deletes old segments by itself; this is just in case it misses any.
+		ticker := time.NewTicker(hlsSegment.Get())
+		defer ticker.Stop()
+		for {
+			select {
+				case <-ticker.C:
+					sweepSegments(dir, 2 * hlsWindow.Get())
+				case <-s.done:
+					return
+			}
+		}
+	}()
+	return dir, nil
+}
+
+// Close stops serving the stream, and removes its directory.
+func (s *hlsStreamer) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	select {
+		case <-s.done:
+			return nil
+		default:
+			close(s.done)
+	}
+	if s.dir == "" {
+		return nil
+	}
+	hlsStreams.Lock()
+	delete(hlsStreams.dirs, s.id)
+	hlsStreams.Unlock()
+	if err := os.RemoveAll(s.dir); err != nil {
+		return fmt.Errorf("could not remove HLS directory %q: %w", s.dir, err)
+	}
+	logme.Debugf("HLS stream %s removed\n", s.id)
+	return nil
+}
+
+// hlsAddress is where the stream can be watched, if the streamer is HLS.
+func hlsAddress(streamer Streamer) string {
+	if s, ok := streamer.(*hlsStreamer); ok {
+		return s.URL()
+	}
+	return ""
+}
+
+// sweepSegments deletes the segments that are older than `maxAge`.
+func sweepSegments(dir string, maxAge time.Duration) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		if !hlsSegmentName.MatchString(entry.Name()) {
+			continue
+		}
+		if info, err := entry.Info(); err == nil && time.Since(info.ModTime()) > maxAge {
+			os.Remove(filepath.Join(dir, entry.Name()))
+		}
+	}
+}
+
+/*
+ *  Router functions
+ */
+
+// serveHLS handles GET /hls/<stream>/<file>, for the playlist and its segments.
+// Like the rest of the media served to viewers, it needs no token; stream IDs are random.
+func serveHLS(c *gin.Context) {
+	streamID, file := c.Param("stream"), c.Param("file")
+	hlsStreams.RLock()
+	dir, ok := hlsStreams.dirs[streamID]
+	hlsStreams.RUnlock()
+	if !ok {
+		checkErrReply(c, http.StatusNotFound, "hls", fmt.Errorf("no HLS stream %q", streamID))
+		return
+	}
+	switch {
+		case file == hlsPlaylist:
+			c.Header("Content-Type", "application/vnd.apple.mpegurl")
+			c.Header("Cache-Control", "no-cache")
+		case hlsSegmentName.MatchString(file):
+			c.Header("Content-Type", "video/mp2t")
+		default:
+			checkErrReply(c, http.StatusNotFound, "hls", fmt.Errorf("no such file %q", file))
+			return
+	}
+	full := filepath.Join(dir, file)
+	if _, err := os.Stat(full); err != nil {
+		// the playlist only shows up after the first segment is written.
+		checkErrReply(c, http.StatusNotFound, "hls", fmt.Errorf("%q not available (yet?)", file))
+		return
+	}
+	c.File(full)
+}
@@ -0,0 +1,279 @@
+// Icecast source client.
+// In-world radios want a plain HTTP audio stream, which is what Icecast serves. StreamDude
+// connects to Icecast as a source (with PUT, or SOURCE for older servers), keeps the
+// connection open for the whole playlist, and feeds it with one ffmpeg per track, encoding
+// to MP3, AAC or Ogg Vorbis on its standard output. On each track change, the stream title
+// is updated, as ICY metadata.
+//
+// © 2023 by Gwyneth Llewelyn. All rights reserved.
+// Licensed under a MIT License (see https://gwyneth-llewelyn.mit-license.org/).
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	icecastURL setting[string]	// Icecast mount URL, e.g. http://127.0.0.1:8000/radio.mp3.
+	icecastUser setting[string]	// source user; "source", unless the mount says otherwise.
+	icecastPassword setting[string]	// source password.
+	icecastMethod setting[string]	// PUT (Icecast 2.4 and later) or SOURCE (older servers).
+	icecastFormat setting[string]	// mp3, aac or ogg.
+	icecastBitrate setting[string]	// audio bitrate, as for ffmpeg, e.g. "128k".
+	icecastName setting[string]	// stream name, shown by Icecast and by players.
+)
+
+// How long to wait for Icecast to accept the source, a metadata update, or each write of
+// the stream itself.
+var icecastTimeout = 10 * time.Second
+
+// icecastFormats are the ffmpeg options and content type for each format. The sample rate
+// and channels are fixed, since they can't change in the middle of a stream.
+var icecastFormats = map[string]struct{
+	contentType string
+	args []string
+}{
+	"mp3":	{"audio/mpeg", []string{"-c:a", "libmp3lame", "-f", "mp3", "-id3v2_version", "0", "-write_xing", "0"}},
+	"aac":	{"audio/aac", []string{"-c:a", "aac", "-f", "adts"}},
+	"ogg":	{"audio/ogg", []string{"-c:a", "libvorbis", "-f", "ogg"}},
+}
+
+// icecastStreamer streams to an Icecast mount. Each one keeps its own connection, opened
+// when the first track is published, and kept until closed, so that listeners aren't
+// dropped between tracks; see lookupStreamer.
+type icecastStreamer struct {
+	base string
+	user string
+	password string
+	method string
+	format string
+	bitrate string
+	name string
+
+	mu sync.Mutex
+	conn net.Conn		// nil until the first track, or after an error.
+}
+
+func (s *icecastStreamer) Name() string {
+	return "icecast"
+}
+
+// mount parses the URL, which must have the mount on its path.
+func (s *icecastStreamer) mount() (*url.URL, error) {
+	u, err := parseStreamURL(s.base, "http", "https")
+	if err != nil {
+		return nil, err
+	}
+	if strings.Trim(u.Path, "/") == "" {
+		return nil, fmt.Errorf("no mount on %q", obfuscateURL(s.base))
+	}
+	if _, ok := icecastFormats[s.format]; !ok {
+		return nil, fmt.Errorf("unknown Icecast format %q (expected mp3, aac or ogg)", s.format)
+	}
+	if s.method != http.MethodPut && s.method != "SOURCE" {
+		return nil, fmt.Errorf("unknown Icecast method %q (expected PUT or SOURCE)", s.method)
+	}
+	return u, nil
+}
+
+// Publish connects to Icecast, if not yet connected, and sets the stream title for the
+// new track. ffmpeg writes to its standard output, which goes to Icecast (see Write).
+func (s *icecastStreamer) Publish(filename string) (string, []string, error) {
+	u, err := s.mount()
+	if err != nil {
+		return "", nil, err
+	}
+	title := streamTitle(filename)
+	args := []string{"-vn", "-ar", "44100", "-ac", "2", "-b:a", s.bitrate, "-metadata", "title=" + title}
+	args = append(args, icecastFormats[s.format].args...)
+	if filename == "" {
+		return "pipe:1", args, nil	// just checking.
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn == nil {
+		if s.conn, err = s.connect(u); err != nil {
+			return "", nil, err
+		}
+		logme.Infof("icecast: streaming to %s\n", obfuscateURL(u.String()))
+	}
+	// Ogg streams carry their own titles; Icecast doesn't take updates for them.
+	if s.format != "ogg" {
+		if err = s.updateTitle(u, title); err != nil {
+			logme.Warnf("icecast: could not update the stream title: %s\n", err)
+		}
+	}
+	return "pipe:1", args, nil
+}
+
+func (s *icecastStreamer) Redact(target string) string {
+	return obfuscateURL(s.base)		// the target is just ffmpeg's standard output.
+}
+
+// connect logs in as a source, and returns the connection ready to send the stream.
+func (s *icecastStreamer) connect(u *url.URL) (net.Conn, error) {
+	host := u.Host
+	if u.Port() == "" {
+		if u.Scheme == "https" {
+			host = net.JoinHostPort(u.Hostname(), "443")
+		} else {
+			host = net.JoinHostPort(u.Hostname(), "80")
+		}
+	}
+	dialer := &net.Dialer{Timeout: icecastTimeout}
+	var (
+		conn net.Conn
+		err error
+	)
+	if u.Scheme == "https" {
+		conn, err = tls.DialWithDialer(dialer, "tcp", host, &tls.Config{ServerName: u.Hostname()})
+	} else {
+		conn, err = dialer.Dial("tcp", host)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not connect to Icecast: %w", err)
+	}
+	conn.SetDeadline(time.Now().Add(icecastTimeout))
+
+	// Icecast doesn't like chunked bodies, so the request is written by hand.
+	proto := "HTTP/1.1"
+	if s.method == "SOURCE" {
+		proto = "HTTP/1.0"
+	}
+	var req strings.Builder
+	fmt.Fprintf(&req, "%s %s %s\r\n", s.method, u.EscapedPath(), proto)
+	fmt.Fprintf(&req, "Host: %s\r\n", u.Host)
+	fmt.Fprintf(&req, "Authorization: Basic %s\r\n", base64.StdEncoding.EncodeToString([]byte(s.user + ":" + s.password)))
+	fmt.Fprintf(&req, "User-Agent: StreamDude\r\n")
+	fmt.Fprintf(&req, "Content-Type: %s\r\n", icecastFormats[s.format].contentType)
+	fmt.Fprintf(&req, "Ice-Name: %s\r\n", s.name)
+	fmt.Fprintf(&req, "Ice-Public: 0\r\n")
+	if kbps := strings.TrimSuffix(strings.ToLower(s.bitrate), "k"); kbps != "" {
+		fmt.Fprintf(&req, "Ice-Bitrate: %s\r\n", kbps)
+		fmt.Fprintf(&req, "Ice-Audio-Info: bitrate=%s;samplerate=44100;channels=2\r\n", kbps)
+	}
+	if s.method == http.MethodPut {
+		fmt.Fprintf(&req, "Expect: 100-continue\r\n")
+	}
+	req.WriteString("\r\n")
+	if _, err = io.WriteString(conn, req.String()); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("could not send the source request to Icecast: %w", err)
+	}
+
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("no answer from Icecast: %w", err)
+	}
+	if resp.StatusCode != http.StatusContinue && resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("Icecast refused the source: %s", resp.Status)
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+// updateTitle sets the stream title (as sent by Icecast on the ICY metadata) via the
+// admin interface, which takes the source credentials for its own mount.
+func (s *icecastStreamer) updateTitle(u *url.URL, title string) error {
+	admin := *u
+	admin.Path, admin.User = "/admin/metadata", nil
+	admin.RawQuery = url.Values{"mode": {"updinfo"}, "mount": {u.Path}, "song": {title}, "charset": {"UTF-8"}}.Encode()
+	ctx, cancel := context.WithTimeout(context.Background(), icecastTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, admin.String(), nil)
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth(s.user, s.password)
+	req.Header.Set("User-Agent", "StreamDude")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Icecast answered %s", resp.Status)
+	}
+	logme.Debugf("icecast: stream title is now %q\n", title)
+	return nil
+}
+
+// SetTitle updates the stream title without publishing anything new, for when the same
+// ffmpeg goes on to the next track.
+func (s *icecastStreamer) SetTitle(title string) error {
+	if s.format == "ogg" {
+		return nil
+	}
+	u, err := s.mount()
+	if err != nil {
+		return err
+	}
+	return s.updateTitle(u, title)
+}
+
+// Write sends the stream to Icecast; ffmpeg's standard output goes here. After an error,
+// including Icecast not taking the data within icecastTimeout, the connection is dropped,
+// and the next track connects again.
+func (s *icecastStreamer) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	conn := s.conn
+	s.mu.Unlock()
+	if conn == nil {
+		return 0, fmt.Errorf("not connected to Icecast")
+	}
+	conn.SetWriteDeadline(time.Now().Add(icecastTimeout))
+	n, err := conn.Write(p)
+	if err != nil {
+		logme.Errorf("icecast: connection lost: %s\n", err)
+		s.mu.Lock()
+		if s.conn == conn {
+			s.conn = nil
+		}
+		s.mu.Unlock()
+		conn.Close()
+	}
+	return n, err
+}
+
+// Close ends the stream, taking the mount off the air.
+func (s *icecastStreamer) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn == nil {
+		return nil
+	}
+	err := s.conn.Close()
+	s.conn = nil
+	logme.Infoln("icecast: stream ended")
+	return err
+}
+
+// streamTitle is "Artist - Title", from the tags if possible, or else the file name.
+func streamTitle(filename string) string {
+	if filename == "" {
+		return ""
+	}
+	if tags, _ := readTags(filename); tags != nil && tags.Title != "" {
+		if tags.Artist != "" {
+			return tags.Artist + " - " + tags.Title
+		}
+		return tags.Title
+	}
+	return strings.TrimSuffix(filepath.Base(filename), filepath.Ext(filename))
+}
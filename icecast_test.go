@@ -0,0 +1,285 @@
+// Tests for the Icecast source client (see icecast.go), against a stand-in Icecast server
+// listening on a local port.
+//
+// © 2023 by Gwyneth Llewelyn. All rights reserved.
+// Licensed under a MIT License (see https://gwyneth-llewelyn.mit-license.org/).
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// icecastStandIn accepts sources and metadata updates, like Icecast would, and records them.
+type icecastStandIn struct {
+	listener net.Listener
+	status string			// answer to sources, e.g. "100 Continue" or "401 Unauthorized".
+	stuck chan struct{}		// if set, sources are never read from, until it is closed.
+
+	mu sync.Mutex
+	sources []*http.Request
+	titles []string
+	received strings.Builder	// what sources sent after the handshake.
+	done chan struct{}			// closed when a source disconnects.
+}
+
+func newIcecastStandIn(t *testing.T, status string) *icecastStandIn {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("could not listen: %s", err)
+	}
+	s := &icecastStandIn{listener: listener, status: status, done: make(chan struct{})}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go s.handle(conn)
+		}
+	}()
+	return s
+}
+
+// url is the mount on the stand-in.
+func (s *icecastStandIn) url(mount string) string {
+	return "http://" + s.listener.Addr().String() + mount
+}
+
+func (s *icecastStandIn) handle(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	req, err := http.ReadRequest(reader)
+	if err != nil {
+		return
+	}
+	if req.Method == http.MethodGet && req.URL.Path == "/admin/metadata" {
+		s.mu.Lock()
+		s.titles = append(s.titles, req.URL.Query().Get("song"))
+		s.mu.Unlock()
+		io.WriteString(conn, "HTTP/1.0 200 OK\r\nContent-Type: text/xml\r\nContent-Length: 0\r\n\r\n")
+		return
+	}
+	s.mu.Lock()
+	s.sources = append(s.sources, req)
+	s.mu.Unlock()
+	io.WriteString(conn, req.Proto + " " + s.status + "\r\n\r\n")
+	if !strings.HasPrefix(s.status, "100") && !strings.HasPrefix(s.status, "200") {
+		return
+	}
+	if s.stuck != nil {
+		<-s.stuck
+		return
+	}
+	// the stream is the body, without any framing, until the source goes away.
+	data, _ := io.ReadAll(reader)
+	s.mu.Lock()
+	s.received.Write(data)
+	s.mu.Unlock()
+	close(s.done)
+}
+
+func newTestIcecastStreamer(base, method, format string) *icecastStreamer {
+	return &icecastStreamer{
+		base:		base,
+		user:		"source",
+		password:	"hackme",
+		method:		method,
+		format:		format,
+		bitrate:	"128k",
+		name:		"Test Radio",
+	}
+}
+
+func TestIcecastHandshake(t *testing.T) {
+	tests := []struct {
+		method string
+		status string
+		proto string
+	}{
+		{http.MethodPut, "100 Continue", "HTTP/1.1"},
+		{http.MethodPut, "200 OK", "HTTP/1.1"},
+		{"SOURCE", "200 OK", "HTTP/1.0"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.method + " " + tt.status, func(t *testing.T) {
+			standIn := newIcecastStandIn(t, tt.status)
+			streamer := newTestIcecastStreamer(standIn.url("/radio.mp3"), tt.method, "mp3")
+			u, err := streamer.mount()
+			if err != nil {
+				t.Fatalf("invalid mount: %s", err)
+			}
+			conn, err := streamer.connect(u)
+			if err != nil {
+				t.Fatalf("connect failed: %s", err)
+			}
+			streamer.conn = conn
+			if _, err = streamer.Write([]byte("some MP3 frames")); err != nil {
+				t.Fatalf("Write failed: %s", err)
+			}
+			if err = streamer.Close(); err != nil {
+				t.Errorf("Close failed: %s", err)
+			}
+			select {
+				case <-standIn.done:
+				case <-time.After(5 * time.Second):
+					t.Fatal("the stand-in never saw the source go away")
+			}
+
+			standIn.mu.Lock()
+			defer standIn.mu.Unlock()
+			if len(standIn.sources) != 1 {
+				t.Fatalf("got %d source requests, want 1", len(standIn.sources))
+			}
+			req := standIn.sources[0]
+			if req.Method != tt.method || req.Proto != tt.proto || req.URL.Path != "/radio.mp3" {
+				t.Errorf("request line is %s %s %s, want %s /radio.mp3 %s", req.Method, req.URL.Path, req.Proto, tt.method, tt.proto)
+			}
+			if user, password, _ := req.BasicAuth(); user != "source" || password != "hackme" {
+				t.Errorf("authenticated as %s:%s, want source:hackme", user, password)
+			}
+			for header, want := range map[string]string{
+				"Content-Type":		"audio/mpeg",
+				"Ice-Name":			"Test Radio",
+				"Ice-Bitrate":		"128",
+				"Ice-Public":		"0",
+			} {
+				if got := req.Header.Get(header); got != want {
+					t.Errorf("%s is %q, want %q", header, got, want)
+				}
+			}
+			if expect := req.Header.Get("Expect"); (expect == "100-continue") != (tt.method == http.MethodPut) {
+				t.Errorf("Expect is %q for %s", expect, tt.method)
+			}
+			if got := standIn.received.String(); got != "some MP3 frames" {
+				t.Errorf("Icecast got %q, want %q", got, "some MP3 frames")
+			}
+		})
+	}
+}
+
+func TestIcecastRefused(t *testing.T) {
+	standIn := newIcecastStandIn(t, "401 Unauthorized")
+	streamer := newTestIcecastStreamer(standIn.url("/radio.mp3"), http.MethodPut, "mp3")
+	if _, _, err := streamer.Publish("/media/song.mp3"); err == nil {
+		t.Fatal("Publish succeeded, even though Icecast refused the source")
+	}
+	if _, err := streamer.Write([]byte("data")); err == nil {
+		t.Error("Write succeeded without a connection")
+	}
+}
+
+func TestIcecastWriteTimeout(t *testing.T) {
+	standIn := newIcecastStandIn(t, "100 Continue")
+	standIn.stuck = make(chan struct{})
+	defer close(standIn.stuck)
+	defer func(timeout time.Duration) { icecastTimeout = timeout }(icecastTimeout)
+	icecastTimeout = 200 * time.Millisecond
+
+	streamer := newTestIcecastStreamer(standIn.url("/radio.mp3"), http.MethodPut, "mp3")
+	if _, _, err := streamer.Publish("/media/song.mp3"); err != nil {
+		t.Fatalf("Publish failed: %s", err)
+	}
+	// once the socket buffers are full, writes must give up instead of blocking forever.
+	chunk := make([]byte, 64 * 1024)
+	var err error
+	for written := 0; err == nil && written < 256 << 20; written += len(chunk) {
+		_, err = streamer.Write(chunk)
+	}
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("Write error = %v, want %v", err, os.ErrDeadlineExceeded)
+	}
+	streamer.mu.Lock()
+	defer streamer.mu.Unlock()
+	if streamer.conn != nil {
+		t.Error("the connection was not dropped")
+	}
+}
+
+func TestIcecastPublish(t *testing.T) {
+	standIn := newIcecastStandIn(t, "100 Continue")
+	streamer := newTestIcecastStreamer(standIn.url("/radio.mp3"), http.MethodPut, "mp3")
+
+	// the connection is opened once, for all tracks; the title changes on each one.
+	for _, filename := range []string{"/media/First Song.mp3", "/media/Second Song.mp3"} {
+		target, args, err := streamer.Publish(filename)
+		if err != nil {
+			t.Fatalf("Publish(%q) failed: %s", filename, err)
+		}
+		if target != "pipe:1" {
+			t.Errorf("Publish(%q) target = %q, want pipe:1", filename, target)
+		}
+		if !strings.Contains(strings.Join(args, " "), "-c:a libmp3lame -f mp3") {
+			t.Errorf("Publish(%q) args = %q, expected MP3 output", filename, args)
+		}
+	}
+	if err := streamer.SetTitle("Someone - Third Song"); err != nil {
+		t.Errorf("SetTitle failed: %s", err)
+	}
+	if redacted := streamer.Redact("pipe:1"); strings.Contains(redacted, "hackme") {
+		t.Errorf("Redact shows the password: %q", redacted)
+	}
+	streamer.Close()
+	<-standIn.done
+
+	standIn.mu.Lock()
+	defer standIn.mu.Unlock()
+	if len(standIn.sources) != 1 {
+		t.Errorf("got %d source connections, want 1", len(standIn.sources))
+	}
+	want := []string{"First Song", "Second Song", "Someone - Third Song"}
+	if strings.Join(standIn.titles, "|") != strings.Join(want, "|") {
+		t.Errorf("titles were %q, want %q", standIn.titles, want)
+	}
+}
+
+func TestIcecastUpdateTitle(t *testing.T) {
+	standIn := newIcecastStandIn(t, "100 Continue")
+	streamer := newTestIcecastStreamer(standIn.url("/radio.mp3"), http.MethodPut, "mp3")
+	u, _ := url.Parse(streamer.base)
+	if err := streamer.updateTitle(u, "Ação & Reação"); err != nil {
+		t.Fatalf("updateTitle failed: %s", err)
+	}
+	// Ogg streams carry their own titles.
+	streamer.format = "ogg"
+	if err := streamer.SetTitle("Not Sent"); err != nil {
+		t.Fatalf("SetTitle failed: %s", err)
+	}
+	standIn.mu.Lock()
+	defer standIn.mu.Unlock()
+	if len(standIn.titles) != 1 || standIn.titles[0] != "Ação & Reação" {
+		t.Errorf("titles were %q, want just %q", standIn.titles, "Ação & Reação")
+	}
+}
+
+func TestIcecastMount(t *testing.T) {
+	tests := []struct {
+		base string
+		method string
+		format string
+		wantErr bool
+	}{
+		{"http://127.0.0.1:8000/radio.mp3", http.MethodPut, "mp3", false},
+		{"https://icecast.example.com/radio.aac", "SOURCE", "aac", false},
+		{"http://127.0.0.1:8000/", http.MethodPut, "mp3", true},			// no mount.
+		{"http://127.0.0.1:8000/radio", http.MethodPut, "flac", true},		// unknown format.
+		{"http://127.0.0.1:8000/radio", http.MethodPost, "mp3", true},		// unknown method.
+		{"rtsp://127.0.0.1:8000/radio", http.MethodPut, "mp3", true},		// not HTTP.
+	}
+	for _, tt := range tests {
+		_, err := newTestIcecastStreamer(tt.base, tt.method, tt.format).mount()
+		if (err != nil) != tt.wantErr {
+			t.Errorf("mount of %s (%s, %s): error = %v, want error: %t", tt.base, tt.method, tt.format, err, tt.wantErr)
+		}
+	}
+}
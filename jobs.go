@@ -0,0 +1,444 @@
+// Supervisor for the external processes (i.e. ffmpeg) launched by StreamDude.
+// Every process gets a job ID, so that it can be inspected and stopped via the API.
+//
+// © 2023 by Gwyneth Llewelyn. All rights reserved.
+// Licensed under a MIT License (see https://gwyneth-llewelyn.mit-license.org/).
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os/exec"
+	"runtime"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/dchest/uniuri"
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+)
+
+// JobState is the lifecycle state of a job.
+type JobState string
+
+const (
+	JobRunning	JobState = "running"	// process started and still running.
+	JobStopping	JobState = "stopping"	// we asked it to stop, but it hasn't exited yet.
+	JobStopped	JobState = "stopped"	// stopped at our request.
+	JobFinished	JobState = "finished"	// exited by itself, without errors.
+	JobFailed	JobState = "failed"		// exited by itself, with errors.
+)
+
+const (
+	jobStderrLines		= 20	// how many lines of stderr we keep for each job.
+	jobMaxFinished		= 50	// how many finished jobs we keep around for inspection.
+)
+
+var (
+	errJobUnknown		= errors.New("no such job")
+	errJobNotRunning	= errors.New("job is not running")
+)
+
+// jobStopGrace is how long we wait after SIGTERM before sending SIGKILL.
+var jobStopGrace setting[time.Duration]
+
+// Job is a supervised external process.
+type Job struct {
+	mu sync.RWMutex
+	id string
+	state JobState
+	pid int
+	started time.Time
+	ended time.Time
+	source string				// file being streamed.
+	target string				// where it's being streamed to.
+	exitCode int
+	stderr []string				// last jobStderrLines lines of stderr output.
+	progress JobProgress		// last progress report, if the process sends them.
+	slowSince time.Time			// when the process started running below jobStallSpeed.
+	cmd *exec.Cmd
+	done chan struct{}			// closed when the process exits.
+}
+
+// JobStatus is a snapshot of a job, suitable for JSON/XML encoding.
+type JobStatus struct {
+	ID string			`json:"id" xml:"id"`
+	State JobState		`json:"state" xml:"state"`
+	PID int				`json:"pid" xml:"pid"`
+	Started time.Time	`json:"started" xml:"started"`
+	Ended *time.Time	`json:"ended,omitempty" xml:"ended,omitempty"`
+	Source string		`json:"source" xml:"source"`
+	Target string		`json:"target" xml:"target"`
+	ExitCode *int		`json:"exitCode,omitempty" xml:"exitCode,omitempty"`
+	Progress *JobProgress	`json:"progress,omitempty" xml:"progress,omitempty"`
+	Stderr []string		`json:"stderr" xml:"stderr>line"`
+}
+
+// ID returns the job identifier.
+func (j *Job) ID() string {
+	return j.id
+}
+
+// Done returns a channel that is closed when the process exits.
+func (j *Job) Done() <-chan struct{} {
+	return j.done
+}
+
+// Running is true while the process hasn't exited yet.
+func (j *Job) Running() bool {
+	j.mu.RLock()
+	defer j.mu.RUnlock()
+	return j.state == JobRunning || j.state == JobStopping
+}
+
+// Status returns a snapshot of the job.
+func (j *Job) Status() JobStatus {
+	j.mu.RLock()
+	defer j.mu.RUnlock()
+	status := JobStatus{
+		ID:			j.id,
+		State:		j.state,
+		PID:		j.pid,
+		Started:	j.started,
+		Source:		j.source,
+		Target:		j.target,
+		Stderr:		append([]string(nil), j.stderr...),
+	}
+	if !j.ended.IsZero() {
+		ended, exitCode := j.ended, j.exitCode
+		status.Ended, status.ExitCode = &ended, &exitCode
+	}
+	if !j.progress.Updated.IsZero() {
+		progress := j.progress
+		status.Progress = &progress
+	}
+	return status
+}
+
+// addStderr appends a line to the stderr ring.
+func (j *Job) addStderr(line string) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if len(j.stderr) >= jobStderrLines {
+		j.stderr = j.stderr[1:]
+	}
+	j.stderr = append(j.stderr, line)
+}
+
+// Stop sends SIGTERM to the process and, if it's still around after `grace`, SIGKILL.
+// It does not wait for the process to exit; use Done() for that.
+func (j *Job) Stop(grace time.Duration) error {
+	j.mu.Lock()
+	if j.state != JobRunning {
+		j.mu.Unlock()
+		return errJobNotRunning
+	}
+	j.state = JobStopping
+	process := j.cmd.Process
+	j.mu.Unlock()
+
+	logme.Infof("stopping job %s (PID %d)\n", j.id, process.Pid)
+	if err := process.Signal(syscall.SIGTERM); err != nil {
+		return err
+	}
+	go func() {
+		select {
+			case <-j.done:
+			case <-time.After(grace):
+				logme.Warnf("job %s (PID %d) ignored SIGTERM for %v, killing it\n", j.id, process.Pid, grace)
+				if err := process.Kill(); err != nil {
+					logme.Errorf("could not kill job %s: %s\n", j.id, err)
+				}
+		}
+	}()
+	return nil
+}
+
+// JobManager keeps track of all jobs.
+type JobManager struct {
+	mu sync.RWMutex
+	jobs map[string]*Job
+}
+
+// Global job manager.
+var jobs = NewJobManager()
+
+// NewJobManager returns an empty job manager.
+func NewJobManager() *JobManager {
+	return &JobManager{jobs: make(map[string]*Job)}
+}
+
+// Start launches a command and supervises it until it exits.
+// `source` and `target` are purely informative.
+// Unless the caller has set cmd.Stdout, standard output is parsed as ffmpeg progress reports
+// (see ffmpeg-progress.go), and stalls are watched for.
+func (m *JobManager) Start(cmd *exec.Cmd, source, target string) (*Job, error) {
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return nil, err
+	}
+	var stdout io.ReadCloser
+	if cmd.Stdout == nil {
+		if stdout, err = cmd.StdoutPipe(); err != nil {
+			return nil, err
+		}
+	}
+	if err = cmd.Start(); err != nil {
+		return nil, err
+	}
+	j := &Job{
+		id:			uniuri.NewLen(12),
+		state:		JobRunning,
+		pid:		cmd.Process.Pid,
+		started:	time.Now(),
+		source:		source,
+		target:		target,
+		cmd:		cmd,
+		done:		make(chan struct{}),
+	}
+	m.add(j)
+	logme.Infof("job %s started: %s (PID %d)\n", j.id, cmd.Path, j.pid)
+
+	// Since ffmpeg may be running for a while, wait for it in a goroutine.
+	go func() {
+		runtime.LockOSThread()	// lock to safely execute programs.
+		defer runtime.UnlockOSThread()
+
+		// both pipes must be fully read before calling Wait().
+		var readers sync.WaitGroup
+		if stdout != nil {
+			readers.Add(1)
+			go func() {
+				defer readers.Done()
+				j.collectProgress(stdout)
+			}()
+		}
+		j.collectStderr(stderr)
+		readers.Wait()
+		err := cmd.Wait()
+
+		j.mu.Lock()
+		j.ended = time.Now()
+		j.exitCode = cmd.ProcessState.ExitCode()
+		switch {
+			case j.state == JobStopping:
+				j.state = JobStopped
+			case err != nil:
+				j.state = JobFailed
+			default:
+				j.state = JobFinished
+		}
+		state := j.state
+		j.mu.Unlock()
+		close(j.done)
+
+		if state == JobFailed {
+			logme.Errorf("❌ job %s finished with error: %v\n", j.id, err)
+		} else {
+			logme.Infof("✅ job %s %s (%s)\n", j.id, state, j.source)
+		}
+	}()
+	// Jobs whose output goes elsewhere (e.g. to Icecast) report no progress, so there's
+	// nothing to watch.
+	if stdout != nil {
+		go j.watchProgress(jobStallAfter.Get())
+	}
+
+	return j, nil
+}
+
+// collectStderr reads the process' stderr until EOF, keeping the last lines.
+// ffmpeg uses carriage returns to update its status line, so we split on those, too.
+func (j *Job) collectStderr(r io.Reader) {
+	scanner := bufio.NewScanner(r)
+	scanner.Split(scanLinesOrCR)
+	for scanner.Scan() {
+		if line := string(bytes.TrimSpace(scanner.Bytes())); line != "" {
+			j.addStderr(line)
+			logme.Debugf("[job %s] %s\n", j.id, line)
+		}
+	}
+}
+
+// scanLinesOrCR is a bufio.SplitFunc that splits on either \n or \r.
+func scanLinesOrCR(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	if atEOF && len(data) == 0 {
+		return 0, nil, nil
+	}
+	if i := bytes.IndexAny(data, "\r\n"); i >= 0 {
+		return i + 1, data[:i], nil
+	}
+	if atEOF {
+		return len(data), data, nil
+	}
+	return 0, nil, nil
+}
+
+// add registers a job, pruning the oldest finished jobs if there are too many.
+func (m *JobManager) add(j *Job) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.jobs[j.id] = j
+
+	var finished []*Job
+	for _, job := range m.jobs {
+		if !job.Running() {
+			finished = append(finished, job)
+		}
+	}
+	if len(finished) <= jobMaxFinished {
+		return
+	}
+	sort.Slice(finished, func(a, b int) bool {
+		return finished[a].started.Before(finished[b].started)
+	})
+	for _, job := range finished[:len(finished)-jobMaxFinished] {
+		delete(m.jobs, job.id)
+	}
+}
+
+// Get retrieves a job by ID.
+func (m *JobManager) Get(id string) (*Job, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	j, ok := m.jobs[id]
+	if !ok {
+		return nil, errJobUnknown
+	}
+	return j, nil
+}
+
+// List returns a snapshot of all jobs, most recent first.
+func (m *JobManager) List() []JobStatus {
+	m.mu.RLock()
+	list := make([]JobStatus, 0, len(m.jobs))
+	for _, j := range m.jobs {
+		list = append(list, j.Status())
+	}
+	m.mu.RUnlock()
+	sort.Slice(list, func(a, b int) bool {
+		return list[a].Started.After(list[b].Started)
+	})
+	return list
+}
+
+// Running returns all jobs whose process hasn't exited yet.
+func (m *JobManager) Running() []*Job {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var running []*Job
+	for _, j := range m.jobs {
+		if j.Running() {
+			running = append(running, j)
+		}
+	}
+	return running
+}
+
+// StopAll stops all running jobs (see Job.Stop), and waits until they exit, or until
+// `ctx` is done.
+func (m *JobManager) StopAll(ctx context.Context, grace time.Duration) error {
+	running := m.Running()
+	for _, j := range running {
+		if err := j.Stop(grace); err != nil && !errors.Is(err, errJobNotRunning) {
+			logme.Errorf("could not stop job %s: %s\n", j.id, err)
+		}
+	}
+	for _, j := range running {
+		select {
+			case <-j.Done():
+			case <-ctx.Done():
+				return fmt.Errorf("%d jobs still running: %w", len(m.Running()), ctx.Err())
+		}
+	}
+	return nil
+}
+
+/*
+ *  Router functions
+ */
+
+// tokenFromRequest retrieves the token from the `X-StreamDude-Token` header or the
+// `token` query/form field, for endpoints that don't bind a Command.
+func tokenFromRequest(c *gin.Context) string {
+	if token := c.GetHeader("X-StreamDude-Token"); token != "" {
+		return token
+	}
+	return c.Request.FormValue("token")
+}
+
+// apiListJobs handles GET /api/jobs.
+func apiListJobs(c *gin.Context) {
+	if checkToken(c, "play", tokenFromRequest(c)) == nil {
+		return
+	}
+	list := jobs.List()
+	switch getContentType(c) {
+		case binding.MIMEXML, "application/soap+xml", binding.MIMEXML2:
+			c.XML(http.StatusOK, gin.H{"status": "ok", "jobs": list})
+		case binding.MIMEPlain:
+			var buf bytes.Buffer
+			for _, status := range list {
+				fmt.Fprintf(&buf, "%s %s %d %s\n", status.ID, status.State, status.PID, status.Source)
+			}
+			c.String(http.StatusOK, buf.String())
+		default:
+			c.JSON(http.StatusOK, gin.H{"status": "ok", "jobs": list})
+	}
+}
+
+// apiGetJob handles GET /api/jobs/:id.
+func apiGetJob(c *gin.Context) {
+	if checkToken(c, "play", tokenFromRequest(c)) == nil {
+		return
+	}
+	j, err := jobs.Get(c.Param("id"))
+	if err != nil {
+		checkErrReply(c, http.StatusNotFound, "jobs: " + c.Param("id"), err)
+		return
+	}
+	status := j.Status()
+	switch getContentType(c) {
+		case binding.MIMEXML, "application/soap+xml", binding.MIMEXML2:
+			c.XML(http.StatusOK, gin.H{"status": "ok", "job": status})
+		case binding.MIMEPlain:
+			if status.Progress != nil {
+				c.String(http.StatusOK, "%s %s %d %s %s", status.ID, status.State, status.PID, status.Source, status.Progress)
+				break
+			}
+			c.String(http.StatusOK, "%s %s %d %s", status.ID, status.State, status.PID, status.Source)
+		default:
+			c.JSON(http.StatusOK, gin.H{"status": "ok", "job": status})
+	}
+}
+
+// apiStopJob handles POST /api/jobs/:id/stop.
+func apiStopJob(c *gin.Context) {
+	if checkToken(c, "play", tokenFromRequest(c)) == nil {
+		return
+	}
+	j, err := jobs.Get(c.Param("id"))
+	if err != nil {
+		checkErrReply(c, http.StatusNotFound, "jobs: " + c.Param("id"), err)
+		return
+	}
+	if err = j.Stop(jobStopGrace.Get()); err != nil {
+		checkErrReply(c, http.StatusConflict, "jobs: could not stop " + j.ID(), err)
+		return
+	}
+	switch getContentType(c) {
+		case binding.MIMEXML, "application/soap+xml", binding.MIMEXML2:
+			c.XML(http.StatusAccepted, gin.H{"status": "ok", "message": "stopping job " + j.ID()})
+		case binding.MIMEPlain:
+			c.String(http.StatusAccepted, "STOPPING: " + j.ID())
+		default:
+			c.JSON(http.StatusAccepted, gin.H{"status": "ok", "message": "stopping job " + j.ID()})
+	}
+}
@@ -8,15 +8,13 @@ package main
 
 import (
 	//	"log"
+	"errors"
 	"fmt"
+	"io"
+	"io/fs"
 	"net/http"
-	"net/url"
-	"os"
 	"os/exec"
-	"path/filepath"
-	"runtime"
-	"strconv"
-	// "strings"
+	"strings"
 
 	"github.com/gin-gonic/gin"
 	"github.com/gin-gonic/gin/binding"
@@ -43,59 +41,86 @@ type Command struct {
 	SessionID string	`validate:"omitempty,hexadecimal" xml:"sessionID" json:"sessionID" form:"sessionID" binding:"-"`
 	// Filename to stream (must be a locally-existing file).
 	Filename string		`validate:"omitempty,filepath" xml:"filename" json:"filename" form:"filename" binding:"-"`
+	// Playlist to stream (as returned by /ui/stream or /api/playlists)
+	PlaylistID string	`validate:"omitempty,alphanum" xml:"playlistID" json:"playlistID" form:"playlistID" binding:"-"`
+	// Files selected for streaming from the playlist, in order (must be part of the playlist)
+	Files []string		`validate:"omitempty,dive,filepath" xml:"files>file" json:"files" form:"files" binding:"-"`
+	// If set, only the selected files will be streamed, even if none was selected.
+	Selection bool		`xml:"selection" json:"selection" form:"selection" binding:"-"`
+	// Transcoding profile (see profiles.go); if empty, the default one is used.
+	Profile string		`validate:"omitempty,printascii" xml:"profile" json:"profile" form:"profile" binding:"-"`
+	// Streaming-server backend (see streamers.go); if empty, the default one is used.
+	Backend string		`validate:"omitempty,alphanum" xml:"backend" json:"backend" form:"backend" binding:"-"`
+	// If set, the playlist is streamed as one continuous audio stream (see gapless-player.go).
+	Gapless bool		`xml:"gapless" json:"gapless" form:"gapless" binding:"-"`
 	// LAL Master Key
 	MasterKey string	`validate:"omitempty,alphanum" xml:"masterKey" json:"masterKey" form:"masterKey" binding:"-"`
 }
 
-// Helper function to actually play a file via ffmpeg
-func streamFile(filename string) error {
-	logme.Debugf("Filename to stream: %q; Master key: %q\n", filename, obfuscate(lalMasterKey))
+// Helper function to actually play a file via ffmpeg.
+// ffmpeg is launched as a supervised job (see jobs.go), which is returned.
+// Codecs etc. are set by the transcoding profile; where it goes, by the streamer.
+func streamFile(filename string, profile Profile, streamer Streamer) (*Job, error) {
+	logme.Debugf("Filename to stream: %q; backend: %q\n", filename, streamer.Name())
 
 	// ffmpeg params
 	/*
 	-re -stream_loop -1 -i /var/www/clients/client6/web14/home/betafiles/data/beta-technologies/Universidade de Aveiro/LOCUS Project in Amiais/Panels SL/Painel_Preparativos/Preparativos.mp4 -acodec copy -vcodec copy -f rtsp -muxdelay 0.1 -rtsp_transport tcp rtsp://127.0.0.1:5544/Preparativos.mp4?lal_secret=0126471190816174f602a1e4b3cbd7b6
 	*/
+	job, _, err := streamInput(filename, []string{"-re", "-i", filename}, profile.args(), streamer, false)
+	return job, err
+}
 
-	// for lal server: calculate the simple hash allowing execution.
-	// TODO(gwyneth): deal with the way it works for other streaming services,
-	// where it is more customary to send login/password OOB. (gwyneth 20230803)
-	basename := filepath.Base(filename)
-	calcHash := getMD5Hash(lalMasterKey + basename)
-	cmdURL, err := url.JoinPath(streamerURL, basename)
+// streamInput launches ffmpeg with the given input and encoding options, publishing `name`
+// on the streamer. If `withStdin` is set, ffmpeg's standard input is returned as well, for
+// the caller to feed it; closing it ends the job.
+func streamInput(name string, input []string, encoding []string, streamer Streamer, withStdin bool) (*Job, io.WriteCloser, error) {
+	// each streaming server has its own way of naming and authenticating streams.
+	cmdURL, outArgs, err := streamer.Publish(name)
 	if err != nil {
-		logme.Errorf("❌ Could not create a proper URL from %q: %q\n", filename, err)
-		return err
-	}
-	cmdURL += "?lal_secret=" + calcHash
-	logme.Debugf("conjoined URL for streaming is: %q\n", cmdURL)
-
-	// Since ffmpeg may be running for a while, let's start this in a goroutine
-	// and wait there, while relinquishing resources and allowing other things to run.
-	// (gwyneth 20230803)
-	go func() {
-		runtime.LockOSThread()	// lock to safely execute programs.
-		defer runtime.UnlockOSThread()
-
-		cmd := exec.Command(ffmpegPath, "-re", "-i", filename, "-acodec", "copy", "-vcodec", "copy",
-			"-f", "rtsp", "-muxdelay", "0.1", "-tune", "zerolatency", "-rtsp_transport", "tcp", cmdURL)
-		logme.Debugf("command to be executed: %s\n", cmd.String())
-		// launch ffmpeg, but don't wait for it.
-		err := cmd.Start()
-		if err != nil {
-			logme.Errorf("❌ could not start %s, error was: %s\n", ffmpegPath, err)
-			runtime.Goexit()
+		logme.Errorf("❌ Could not publish %q on %s: %q\n", name, streamer.Name(), err)
+		return nil, nil, err
+	}
+	logme.Debugf("conjoined URL for streaming is: %q\n", streamer.Redact(cmdURL))
+
+	// progress reports go to stdout, to be parsed by the job manager; -nostats keeps them
+	// out of stderr, which is then left for actual errors. Some backends want the stream
+	// itself on stdout, though.
+	pipe, isPipe := streamer.(pipeStreamer)
+	args := []string{"-nostats", "-progress", "pipe:1"}
+	if isPipe {
+		args = []string{"-nostats"}
+	}
+	args = append(args, input...)
+	args = append(args, encoding...)
+	args = append(args, outArgs...)
+	args = append(args, cmdURL)
+	cmd := exec.Command(ffmpegPath.Get(), args...)
+	if isPipe {
+		cmd.Stdout = pipe
+	}
+	var stdin io.WriteCloser
+	if withStdin {
+		if stdin, err = cmd.StdinPipe(); err != nil {
+			return nil, nil, err
 		}
-		logme.Infof("waiting for command to finish...")
-		runtime.Gosched()	// we are waiting, so we yield CPU to other goroutines.
-		err = cmd.Wait()
-		if err != nil {
-			logme.Errorf("❌ command finished with error: %v\n", err)
-			runtime.Goexit()
+	}
+	logme.Debugf("command to be executed: %s\n", strings.ReplaceAll(cmd.String(), cmdURL, streamer.Redact(cmdURL)))
+
+	// launch ffmpeg, but don't wait for it; the job manager will do that for us.
+	job, err := jobs.Start(cmd, name, streamer.Redact(cmdURL))
+	if attacher, ok := streamer.(jobStreamer); ok {
+		attacher.Attach(job)	// nil on error.
+	}
+	if err != nil {
+		logme.Errorf("❌ could not start %s, error was: %s\n", ffmpegPath.Get(), err)
+		if stdin != nil {
+			stdin.Close()
 		}
-		logme.Infof("✅ %s %s terminated with success\n", ffmpegPath, filename)
-	}()
+		return nil, nil, err
+	}
 
-	return nil
+	return job, stdin, nil
 }
 
 
@@ -124,8 +149,7 @@ func apiStreamFile(c *gin.Context) {
 
 	logme.Debugf("Bound command: %+v\n", command)
 
-	if command.Token == "" {
-		checkErrReply(c, http.StatusUnauthorized, "play", fmt.Errorf("no valid token sent"))
+	if checkToken(c, "play", command.Token) == nil {
 		return
 	}
 
@@ -133,74 +157,214 @@ func apiStreamFile(c *gin.Context) {
 		checkErrReply(c, http.StatusBadRequest, "play", fmt.Errorf("empty filename, cannot proceed"))
 		return
 	}
-	// attempt to expand tilde (~) to user's home directory
-	if command.Filename, err = expandPath(command.Filename); err != nil {
-		checkErrReply(c, http.StatusBadRequest, "play: filename with ~ not properly expanded to existing file", err)
+	profile, err := lookupProfile(command.Profile)
+	if err != nil {
+		checkErrReply(c, http.StatusBadRequest, "play: invalid profile", err)
 		return
 	}
-	// does the file exist?
-	if _, err := os.Stat(command.Filename); err != nil {
-		checkErrReply(c, http.StatusNotFound, fmt.Sprintf("play: filename %q for streaming not found", command.Filename),
-		err)
+	streamer, err := lookupStreamer(command.Backend)
+	if err != nil {
+		checkErrReply(c, http.StatusBadRequest, "play: invalid backend", err)
+		return
 	}
-	// we should be good to go now!
-	resultError := streamFile(command.Filename)
-
-	checkErrReply(c, http.StatusNotFound, fmt.Sprintf("could not play %q", command.Filename), resultError)
-	if resultError != nil {
-		switch responseContent {
-			case binding.MIMEJSON:
-				c.JSON(http.StatusBadRequest, gin.H{
-					"status": "error",
-					"message": "Error playing " + command.Filename + ": " + err.Error(),
-				})
-			case binding.MIMEHTML, binding.MIMEPOSTForm, binding.MIMEMultipartPOSTForm:
-				c.HTML(http.StatusBadRequest, "generic.tpl", environment(c, gin.H{
-					"Title"			: "Error during play",
-					"description"	: "The file failed to stream",
-					"Text"			: "Error playing " + command.Filename + ": " + err.Error(),
-				}))
-			case binding.MIMEXML, "application/soap+xml", binding.MIMEXML2:
-				c.XML(http.StatusBadRequest, gin.H{
-						"status": "error",
-						"message": "Error playing " + command.Filename + ": " + err.Error(),
-					})
-			case binding.MIMEPlain:
-				fallthrough
+	// expand tilde (~) and make sure the file is inside one of the allowed media roots
+	if command.Filename, err = resolveMediaFile(command.Filename); err != nil {
+		switch {
+			case errors.Is(err, errOutsideMediaRoots):
+				checkErrReply(c, http.StatusForbidden, "play: filename not allowed", err)
+			case errors.Is(err, fs.ErrNotExist):
+				checkErrReply(c, http.StatusNotFound, "play: filename for streaming not found", err)
 			default:
-				// minimalistic output, good for embedding
-				c.String(http.StatusBadRequest, command.Filename + " successfully played")
+				checkErrReply(c, http.StatusBadRequest, "play: invalid filename", err)
 		}
 		return
 	}
+	// make sure that ffmpeg will be able to do something with it.
+	if _, err = probeMedia(command.Filename); err != nil {
+		if !errors.Is(err, errProbeUnavailable) {
+			checkErrReply(c, http.StatusUnprocessableEntity, "play: file cannot be played", err)
+			return
+		}
+		logme.Debugf("could not check %q before streaming: %s\n", command.Filename, err)
+	}
+	// we should be good to go now!
+	job, resultError := streamFile(command.Filename, profile, streamer)
+	if closer, ok := streamer.(io.Closer); ok {
+		// a single file is all there is to stream; see streamers.go.
+		go func() {
+			if job != nil {
+				<-job.Done()
+			}
+			closer.Close()
+		}()
+	}
+	if resultError != nil {
+		checkErrReply(c, http.StatusInternalServerError, fmt.Sprintf("could not play %q", command.Filename), resultError)
+		return
+	}
+
+	reply := gin.H{
+		"status": "ok",
+		"message": command.Filename + " successfully played",
+		"job": job.ID(),
+	}
+	jobText := "job " + job.ID()
+	// HLS is served by ourselves, so the caller must be told where (see hls.go).
+	if hls := hlsAddress(streamer); hls != "" {
+		reply["hls"] = hls
+		jobText += ", HLS on " + hls
+	}
 
 	switch responseContent {
 		case binding.MIMEJSON:
-			c.JSON(http.StatusOK, gin.H{
-				"status": "ok",
-				"message": command.Filename + " successfully played",
-			})
+			c.JSON(http.StatusOK, reply)
 		case binding.MIMEHTML, binding.MIMEPOSTForm, binding.MIMEMultipartPOSTForm:
 			c.HTML(http.StatusOK, "generic.tpl", environment(c, gin.H{
 				"Title"			: "File successfully played!",
 				"description"	: "The file has been successfully played",
-				"Text"			: command.Filename + " was successfully played!",
+				"Text"			: command.Filename + " was successfully played! (" + jobText + ")",
 			}))
 		case binding.MIMEXML, "application/soap+xml", binding.MIMEXML2:
-			c.XML(http.StatusOK, gin.H{
-					"status": "ok",
-					"message": command.Filename + " successfully played",
-				})
+			c.XML(http.StatusOK, reply)
+		case binding.MIMEPlain:
+			fallthrough
+		default:
+			// minimalistic output, good for embedding
+			c.String(http.StatusOK, command.Filename + " successfully played (" + jobText + ")")
+	}
+}
+
+// Gin handler to stream a playlist, identified by the `playlistID` field.
+// The playlist must belong to the caller (see playlist.go).
+func apiStreamPath(c *gin.Context) {
+	var command Command
+	responseContent := getContentType(c)
+
+	// add headers from Second Life®/OpenSimulator:
+	command.AvatarKey 	= c.GetHeader("X-SecondLife-Avatar-Key")	// owner, not toucher
+	command.AvatarName	= c.GetHeader("X-SecondLife-Avatar-Name")	// will be overwriten with toucher
+	command.ObjectKey	= c.GetHeader("X-SecondLife-Object-Key")
+	command.ObjectName	= c.GetHeader("X-SecondLife-Object-Name")
+
+	// we should now be able to do some validation on those
+	if err := c.ShouldBind(&command); err != nil {
+		checkErrReply(c, http.StatusInternalServerError, "stream", err)
+		return
+	}
+	token := checkToken(c, "stream", command.Token)
+	if token == nil {
+		return
+	}
+	if command.PlaylistID == "" {
+		checkErrReply(c, http.StatusBadRequest, "[apiStreamPath] - could not stream from " + mediaDirectory.Get(),
+			fmt.Errorf("no playlist ID sent"))
+		return
+	}
+	// Playlists belong to whoever created them, either from the web UI (session) or via the API (token).
+	myPlaylist, err := playlists.Get(command.PlaylistID, requestOwners(c, token)...)
+	if err != nil {
+		checkErrReply(c, http.StatusNotFound, "[apiStreamPath] - playlist " + command.PlaylistID, err)
+		return
+	}
+	playlist := myPlaylist.Items
+	// If the caller has chosen some tracks, stream just those, in the chosen order.
+	if len(command.Files) > 0 || command.Selection {
+		if playlist, err = selectItems(myPlaylist.Items, command.Files); err != nil {
+			checkErrReply(c, http.StatusBadRequest, "[apiStreamPath] - invalid selection", err)
+			return
+		}
+	}
+	logme.Infof("[apiStreamPath] — %d songs to stream from playlist %q\n", len(playlist), myPlaylist.Name)
+	logme.Debugf("[apiStreamPath] - streaming from playlist: %v\n", playlist)
+	logme.Debugf("[apiStreamPath] - bound command: %+v\n", command)
+
+	// We don't want to stream media if the playlist is empty.
+	if len(playlist) == 0 {
+		checkErrReply(c, http.StatusBadRequest, "[apiStreamPath] - could not stream from " + mediaDirectory.Get(),
+			fmt.Errorf("empty playlist passed, or no tracks selected"))
+		return
+	}
+	// Only one playlist may be streamed at a time, no matter by which player.
+	if activePlayer().Status().Active {
+		checkErrReply(c, http.StatusConflict, "[apiStreamPath] - could not stream from " + mediaDirectory.Get(), errPlayerBusy)
+		return
+	}
+	// The player returns as soon as it starts, since it might take a LONG time to play!
+	// The default player (VLC, on builds with the `vlc` tag) is only used for audio; anything
+	// with videos goes through ffmpeg (see ffmpeg-player.go), as do playlists sent to a specific
+	// backend (or when the default isn't lal, e.g. Icecast), since VLC knows nothing about those.
+	// Gapless streams (see gapless-player.go) need no VLC either; when they are the default,
+	// they're only used for audio playlists.
+	gapless := command.Gapless || (gaplessMode.Get() && !hasVideo(playlist))
+	var hls string	// where to watch, if streaming via HLS; it's the same for the whole playlist.
+	if gapless || hasVideo(playlist) || command.Backend != "" || streamerBackend.Get() != "lal" {
+		var (
+			profile Profile
+			streamer Streamer
+		)
+		if profile, err = lookupProfile(command.Profile); err != nil {
+			checkErrReply(c, http.StatusBadRequest, "[apiStreamPath] - invalid profile", err)
+			return
+		}
+		if streamer, err = lookupStreamer(command.Backend); err != nil {
+			checkErrReply(c, http.StatusBadRequest, "[apiStreamPath] - invalid backend", err)
+			return
+		}
+		logme.Infof("[apiStreamPath] - streaming via ffmpeg to %s with profile %q (gapless: %t)\n", streamer.Name(), command.Profile, gapless)
+		hls = hlsAddress(streamer)
+		if gapless {
+			err = continuousPlayer.PlayProfile(playlist, profile, streamer)
+		} else {
+			err = videoPlayer.PlayProfile(playlist, profile, streamer)
+		}
+	} else {
+		err = mediaPlayer.Play(playlist)
+	}
+	if err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, errPlayerBusy) {
+			status = http.StatusConflict
+		}
+		checkErrReply(c, status, "[apiStreamPath] - could not stream from " + mediaDirectory.Get(), err)
+		return
+	}
+
+	reply := gin.H{
+		"status": "ok",
+		"message": "successfully streaming from " + mediaDirectory.Get(),
+	}
+	var hlsText string
+	if hls != "" {
+		reply["hls"] = hls
+		hlsText = " (HLS on " + hls + ")"
+	}
+
+	switch responseContent {
+		case binding.MIMEJSON:
+			c.JSON(http.StatusOK, reply)
+		case binding.MIMEHTML, binding.MIMEPOSTForm, binding.MIMEMultipartPOSTForm:
+			c.HTML(http.StatusOK, "streamdir.tpl", environment(c, gin.H{
+				"Title"			 : skipescape("<i class=\"bi bi-music-note-beamed\" aria-hidden=\"true\"></i><i class=\"bi bi-music-note-beamed\" aria-hidden=\"true\"></i>&nbsp;Stream from media directory"),
+				"description"	 : "Successfully streaming from " + mediaDirectory.Get(),
+				"Text"			 : "👍🆗✅ Successfully streaming (in the background) from " + mediaDirectory.Get() + hlsText,
+				"hasDirList"	 : true,
+				"setBanner"		 : true,
+				"mediaDirectory" : mediaDirectory.Get(),
+				"playlist"		 : myPlaylist.Items,
+				"playlistID"	 : myPlaylist.ID,
+			}))
+		case binding.MIMEXML, "application/soap+xml", binding.MIMEXML2:
+			c.XML(http.StatusOK, reply)
 		case binding.MIMEPlain:
 			fallthrough
 		default:
 			// minimalistic output, good for embedding
-			c.String(http.StatusOK, command.Filename + " successfully played")
+			c.String(http.StatusOK, "successfully streaming from " + mediaDirectory.Get() + hlsText)
 	}
 }
 
 // Handles /auth, gets the object PIN and returns a token.
-// TODO(gwyneth): It's all fake for now.
+// The PIN is checked against the object registry (see objects.go).
 func apiSimpleAuthGenKey(c *gin.Context) {
 	var command Command
 	responseContent := getContentType(c)
@@ -217,26 +381,41 @@ func apiSimpleAuthGenKey(c *gin.Context) {
 		checkErrReply(c, http.StatusInternalServerError, "auth: could not get input data", err)
 		return
 	}
+	// the headers are set by the grid, and cannot be overridden by whatever comes on the body.
+	if key := c.GetHeader("X-SecondLife-Object-Key"); key != "" {
+		command.ObjectKey = key
+	}
+	if key := c.GetHeader("X-SecondLife-Avatar-Key"); key != "" {
+		command.AvatarKey = key
+	}
 
 	logme.Debugf("Bound command: %+v\n", command)
 
-	pin, err := strconv.Atoi(command.ObjectPIN)
-	checkErrReply(c, http.StatusBadRequest, "auth: invalid request: invalid or empty PIN", err)
-	// TODO(gwyneth): obviously, check if this is a valid PIN...
-	if err != nil {
+	if command.ObjectPIN == "" {
+		checkErrReply(c, http.StatusBadRequest, "auth: invalid request", fmt.Errorf("empty PIN"))
+		return
+	}
+	// check the PIN against the registered object (or the LSL signature PIN, without the database)
+	if err := authenticateObject(command.ObjectKey, command.ObjectPIN); err != nil {
+		checkErrReply(c, http.StatusForbidden, "auth: PIN rejected", err)
 		return
 	}
 	// if PIN was correct, save new master key (if it wasn't empty)
 	if command.MasterKey != "" {
-		lalMasterKey = command.MasterKey
+		lalMasterKey.Set(command.MasterKey)
 	}
 
-	logme.Debugf("Got PIN: %v\nGot LAL Master Key: %q\n", pin, obfuscate(command.MasterKey))
+	logme.Debugf("PIN accepted for object %q\nGot LAL Master Key: %q\n", command.ObjectKey, obfuscate(command.MasterKey))
 
-	// generate a random token, to be used for future authentication requests
-	token := randomBase64String(32)
-	// TODO: save the token on persistent storage somewhere, e.g. Redis or other KV store.
-	logme.Debugln("Generated token:")
+	// generate a random token, to be used for future authentication requests,
+	// and save it on the token store.
+	issued, err := tokenStore.Issue(command.ObjectKey, command.AvatarKey, tokenTTL.Get())
+	if err != nil {
+		checkErrReply(c, http.StatusInternalServerError, "auth: could not save token", err)
+		return
+	}
+	token := issued.Token
+	logme.Debugf("Generated token: %q (expires: %v)\n", obfuscate(token), issued.Expires)
 
 	// For now, we just return the bare-bones token, after checking *how* to
 	// return it, depending on the Content-Type of the request:
@@ -289,13 +468,16 @@ func apiDeleteToken(c *gin.Context) {
 
 	logme.Debugf("Bound command: %+v\n", command)
 
-	if command.Token == "" {
-		checkErrReply(c, http.StatusUnauthorized, "delete", fmt.Errorf("no valid token sent"))
+	if checkToken(c, "delete", command.Token) == nil {
 		return
 	}
 
-	// TODO(gwyneth): no-op for now. In the future, the token shall be removed from the KV store.
-	logme.Infoln("Token", command.Token, "deleted successfully.")
+	// Tokens are not really deleted, but marked as revoked, so that we can tell why they fail.
+	if err := tokenStore.Revoke(command.Token); err != nil {
+		checkErrReply(c, http.StatusInternalServerError, "delete: could not revoke token", err)
+		return
+	}
+	logme.Infoln("Token", obfuscate(command.Token), "deleted successfully.")
 
 	switch responseContent {
 		case binding.MIMEJSON:
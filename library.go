@@ -0,0 +1,448 @@
+// Persistent media library index.
+// Every audio file under the media directory is kept on the embedded database, keyed by
+// path, together with its size, modification time, cover, probe results and tags, so
+// that pages don't need to walk (and probe) the whole library every time.
+// Rescans are incremental: only new or changed files are probed and tagged again, and
+// files that have disappeared are removed.
+//
+// © 2023 by Gwyneth Llewelyn. All rights reserved.
+// Licensed under a MIT License (see https://gwyneth-llewelyn.mit-license.org/).
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"github.com/karrick/godirwalk"
+	bolt "go.etcd.io/bbolt"
+)
+
+// Name of the bucket where the library index is kept.
+var libraryBucket = []byte("library")
+
+// How many changed entries are written to the database on each transaction.
+const libraryBatchSize = 256
+
+var errRescanRunning = errors.New("a rescan is already running")
+
+// LibraryEntry is what we know about each file in the library.
+type LibraryEntry struct {
+	Path string				`json:"path" xml:"path"`
+	Size int64				`json:"size" xml:"size"`
+	ModTime time.Time		`json:"modTime" xml:"modTime"`
+	Cover string			`json:"cover,omitempty" xml:"cover,omitempty"`			// from the album's cover image; see Item() for embedded covers.
+	Media *MediaInfo		`json:"media,omitempty" xml:"media,omitempty"`			// nil if not probed.
+	MediaError string		`json:"mediaError,omitempty" xml:"mediaError,omitempty"`	// why it cannot be played.
+	Tags *Tags				`json:"tags,omitempty" xml:"tags,omitempty"`
+	Indexed time.Time		`json:"indexed" xml:"indexed"`							// when this entry was last updated.
+}
+
+// Item turns a library entry into a playlist item.
+func (e LibraryEntry) Item() PlayListItem {
+	// The Dirent is only used to figure out the file type, and these are all regular files.
+	item := NewPlayListItem(godirwalk.Dirent{}, e.Path, e.Cover, e.ModTime, e.Size, e.MediaError == "")
+	if e.Media != nil {
+		item.setMediaInfo(*e.Media)
+	}
+	item.unplayable = e.MediaError != ""
+	item.tags = e.Tags
+	if item.cover == "" && e.Tags != nil && e.Tags.HasCover {
+		item.cover = coverURL(e.Path)
+	}
+	// a frame from the video itself says more about it than the album cover.
+	if thumbnailDirectory.Get() != "" && item.IsVideo() && !item.unplayable {
+		item.cover = thumbnailURL(e.Path)
+	}
+	return *item
+}
+
+// RescanStatus reports the progress of the current (or last) rescan.
+type RescanStatus struct {
+	Running bool			`json:"running" xml:"running"`
+	Root string				`json:"root" xml:"root"`
+	Started time.Time		`json:"started,omitempty" xml:"started,omitempty"`
+	Finished time.Time		`json:"finished,omitempty" xml:"finished,omitempty"`
+	Scanned int				`json:"scanned" xml:"scanned"`			// files found so far.
+	Changed int				`json:"changed" xml:"changed"`			// new or modified files, (re)indexed.
+	Removed int				`json:"removed" xml:"removed"`			// files no longer found.
+	Total int				`json:"total" xml:"total"`				// entries on the index.
+	Error string			`json:"error,omitempty" xml:"error,omitempty"`
+}
+
+// Library is the index itself; entries are kept in memory and mirrored on the database
+// (if there is one).
+type Library struct {
+	mu sync.RWMutex
+	db *bolt.DB
+	entries map[string]LibraryEntry
+	scanned bool			// at least one rescan has finished.
+	status RescanStatus
+}
+
+// Global library index.
+var library = NewLibrary(nil)
+
+// NewLibrary returns a library index, loading existing entries from `boltDB` (which may be nil).
+func NewLibrary(boltDB *bolt.DB) *Library {
+	l := &Library{db: boltDB, entries: make(map[string]LibraryEntry)}
+	if boltDB == nil {
+		return l
+	}
+	err := boltDB.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(libraryBucket).ForEach(func(k, v []byte) error {
+			var e LibraryEntry
+			if err := json.Unmarshal(v, &e); err != nil {
+				logme.Warnf("skipping invalid library entry %q: %s\n", k, err)
+				return nil
+			}
+			l.entries[string(k)] = e
+			return nil
+		})
+	})
+	if err != nil {
+		logme.Errorf("could not load library index: %s\n", err)
+	}
+	l.scanned = len(l.entries) > 0
+	l.status.Total = len(l.entries)
+	return l
+}
+
+// Scanned is true once the index has anything useful in it.
+func (l *Library) Scanned() bool {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.scanned
+}
+
+// Status returns the progress of the current (or last) rescan.
+func (l *Library) Status() RescanStatus {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	status := l.status
+	status.Total = len(l.entries)
+	return status
+}
+
+// Items returns all indexed files under `root`, as playlist items, sorted by album and track.
+func (l *Library) Items(root string) []PlayListItem {
+	root = absPath(root)
+	l.mu.RLock()
+	items := make([]PlayListItem, 0, len(l.entries))
+	for path, e := range l.entries {
+		if insideDirectory(root, path) {
+			items = append(items, e.Item())
+		}
+	}
+	l.mu.RUnlock()
+	sortByAlbum(items)
+	return items
+}
+
+// Entry returns the index entry for a file.
+func (l *Library) Entry(path string) (LibraryEntry, bool) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	e, ok := l.entries[path]
+	return e, ok
+}
+
+// StartRescan launches a rescan of `root` in the background; only one may run at a time.
+func (l *Library) StartRescan(root string) error {
+	root = absPath(root)
+	if err := l.beginRescan(root); err != nil {
+		return err
+	}
+	go l.rescan(root)
+	return nil
+}
+
+// Rescan rescans `root`, waiting for it to finish.
+func (l *Library) Rescan(root string) error {
+	root = absPath(root)
+	if err := l.beginRescan(root); err != nil {
+		return err
+	}
+	return l.rescan(root)
+}
+
+// absPath makes a path absolute, so that all index entries are, too; this also makes
+// checking if they're inside a directory much cheaper.
+func absPath(path string) string {
+	if abs, err := filepath.Abs(path); err == nil {
+		return abs
+	}
+	return filepath.Clean(path)
+}
+
+// beginRescan marks a rescan as running.
+func (l *Library) beginRescan(root string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.status.Running {
+		return errRescanRunning
+	}
+	l.status = RescanStatus{Running: true, Root: root, Started: time.Now()}
+	return nil
+}
+
+// rescan walks through `root`, (re)indexing new or changed files, and removing the
+// entries for files that are gone, while keeping track of the progress.
+func (l *Library) rescan(root string) error {
+	logme.Infof("library: rescanning %q\n", root)
+	changed, removed, err := l.sync(root, func() {
+		l.mu.Lock()
+		l.status.Scanned++
+		l.mu.Unlock()
+	}, func(n int) {
+		l.mu.Lock()
+		l.status.Changed += n
+		l.mu.Unlock()
+	})
+
+	l.mu.Lock()
+	l.status.Running = false
+	l.status.Finished = time.Now()
+	l.status.Changed, l.status.Removed = changed, removed
+	if err != nil {
+		l.status.Error = err.Error()
+	} else {
+		l.scanned = true
+	}
+	status := l.status
+	l.mu.Unlock()
+	logme.Infof("library: rescan of %q finished in %v: %d files, %d changed, %d removed\n",
+		root, status.Finished.Sub(status.Started).Round(time.Millisecond), status.Scanned, status.Changed, status.Removed)
+	return err
+}
+
+// sync brings the index up to date for everything under the directory `root`.
+// `scanned` is called for every file found, and `saved` after every batch of changes
+// is saved, for progress reports; both may be nil.
+func (l *Library) sync(root string, scanned func(), saved func(int)) (changed int, removed int, err error) {
+	seen := make(map[string]bool)
+	toIndex := make(chan LibraryEntry)
+	indexed := make(chan LibraryEntry)
+
+	// probing is slow, so changed files are indexed in parallel.
+	var workers sync.WaitGroup
+	for range runtime.NumCPU() {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for e := range toIndex {
+				indexed <- indexEntry(e)
+			}
+		}()
+	}
+	// ... and saved in batches.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		batch := make([]LibraryEntry, 0, libraryBatchSize)
+		flush := func() {
+			l.save(batch, nil)
+			changed += len(batch)
+			if saved != nil && len(batch) > 0 {
+				saved(len(batch))
+			}
+			batch = batch[:0]
+		}
+		for e := range indexed {
+			if batch = append(batch, e); len(batch) >= libraryBatchSize {
+				flush()
+			}
+		}
+		flush()
+	}()
+
+	err = walkMedia(root, func(path string, cover string, fi os.FileInfo) {
+		seen[path] = true
+		if scanned != nil {
+			scanned()
+		}
+		old, ok := l.Entry(path)
+		if ok && old.Size == fi.Size() && old.ModTime.Equal(fi.ModTime()) {
+			if old.Cover != cover {
+				// only the cover changed; no need to probe it again.
+				old.Cover = cover
+				indexed <- old
+			}
+			return
+		}
+		toIndex <- LibraryEntry{Path: path, Size: fi.Size(), ModTime: fi.ModTime(), Cover: cover}
+	})
+	close(toIndex)
+	workers.Wait()
+	close(indexed)
+	<-done
+
+	// Anything under root that we haven't seen is gone; but if the walk failed,
+	// we can't be sure of that, so keep everything.
+	if err != nil {
+		return changed, 0, err
+	}
+	gone := l.pathsUnder(root, seen)
+	l.save(nil, gone)
+	return changed, len(gone), nil
+}
+
+// pathsUnder returns all indexed paths that are `root` itself or inside it, except for
+// those in `except` (which may be nil).
+func (l *Library) pathsUnder(root string, except map[string]bool) []string {
+	var paths []string
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	for path := range l.entries {
+		if (path == root || insideDirectory(root, path)) && !except[path] {
+			paths = append(paths, path)
+		}
+	}
+	return paths
+}
+
+// Refresh updates the index for a single path, which may have been created, changed or
+// removed: directories are synced recursively, media files are (re)indexed if they
+// changed, and, if it's gone, all entries for (or under) it are removed.
+func (l *Library) Refresh(path string) error {
+	path = absPath(path)
+	fi, err := os.Stat(path)
+	switch {
+		case errors.Is(err, fs.ErrNotExist):
+			if gone := l.pathsUnder(path, nil); len(gone) > 0 {
+				l.save(nil, gone)
+				logme.Infof("library: %q is gone, %d entries removed\n", path, len(gone))
+			}
+			// if it was the album cover, another image may take its place.
+			if isCoverFile(path) {
+				return l.Refresh(filepath.Dir(path))
+			}
+			return nil
+		case err != nil:
+			return err
+		case fi.IsDir():
+			changed, removed, err := l.sync(path, nil, nil)
+			if changed > 0 || removed > 0 {
+				logme.Infof("library: %q refreshed, %d changed, %d removed\n", path, changed, removed)
+			}
+			return err
+		case isCoverFile(path):
+			// covers apply to the whole directory.
+			return l.Refresh(filepath.Dir(path))
+		case !isMediaFile(path):
+			return nil
+	}
+	cover := folderCover(filepath.Dir(path))
+	if old, ok := l.Entry(path); ok && old.Size == fi.Size() && old.ModTime.Equal(fi.ModTime()) {
+		if old.Cover != cover {
+			old.Cover = cover
+			l.save([]LibraryEntry{old}, nil)
+		}
+		return nil
+	}
+	l.save([]LibraryEntry{indexEntry(LibraryEntry{Path: path, Size: fi.Size(), ModTime: fi.ModTime(), Cover: cover})}, nil)
+	logme.Infof("library: %q indexed\n", path)
+	return nil
+}
+
+// indexEntry probes and reads the tags of a file.
+func indexEntry(e LibraryEntry) LibraryEntry {
+	e.Media, e.MediaError = nil, ""
+	if info, err := probeMedia(e.Path); err == nil {
+		e.Media = &info
+	} else if !errors.Is(err, errProbeUnavailable) {
+		e.MediaError = err.Error()
+	}
+	e.Tags, _ = readTags(e.Path)
+	e.Indexed = time.Now()
+	return e
+}
+
+// save stores updated entries and deletes removed ones, both in memory and on the database.
+func (l *Library) save(updated []LibraryEntry, removed []string) {
+	if len(updated) == 0 && len(removed) == 0 {
+		return
+	}
+	l.mu.Lock()
+	for _, e := range updated {
+		l.entries[e.Path] = e
+	}
+	for _, path := range removed {
+		delete(l.entries, path)
+	}
+	l.mu.Unlock()
+
+	if l.db == nil {
+		return
+	}
+	err := l.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(libraryBucket)
+		for _, e := range updated {
+			buf, err := json.Marshal(e)
+			if err != nil {
+				return err
+			}
+			if err = bucket.Put([]byte(e.Path), buf); err != nil {
+				return err
+			}
+		}
+		for _, path := range removed {
+			if err := bucket.Delete([]byte(path)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		logme.Errorf("library: could not save index: %s\n", err)
+	}
+}
+
+/*
+ *  Router functions
+ */
+
+// apiStartRescan handles POST /api/library/rescan, starting a rescan of the media directory.
+func apiStartRescan(c *gin.Context) {
+	if checkToken(c, "stream", tokenFromRequest(c)) == nil {
+		return
+	}
+	if err := library.StartRescan(mediaDirectory.Get()); err != nil {
+		checkErrReply(c, http.StatusConflict, "library: rescan", err)
+		return
+	}
+	replyRescanStatus(c, http.StatusAccepted, "rescan started")
+}
+
+// apiRescanStatus handles GET /api/library/rescan, reporting the progress of a rescan.
+func apiRescanStatus(c *gin.Context) {
+	if checkToken(c, "stream", tokenFromRequest(c)) == nil {
+		return
+	}
+	replyRescanStatus(c, http.StatusOK, "rescan status")
+}
+
+// replyRescanStatus sends the rescan progress back, in whatever format was requested.
+func replyRescanStatus(c *gin.Context, httpStatus int, message string) {
+	status := library.Status()
+	switch getContentType(c) {
+		case binding.MIMEXML, "application/soap+xml", binding.MIMEXML2:
+			c.XML(httpStatus, gin.H{"status": "ok", "message": message, "rescan": status})
+		case binding.MIMEPlain:
+			state := "idle"
+			if status.Running {
+				state = "running"
+			}
+			c.String(httpStatus, "%s scanned:%d changed:%d removed:%d total:%d", state, status.Scanned, status.Changed, status.Removed, status.Total)
+		default:
+			c.JSON(httpStatus, gin.H{"status": "ok", "message": message, "rescan": status})
+	}
+}
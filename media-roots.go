@@ -0,0 +1,117 @@
+// Allowed media roots.
+// Files requested for streaming must live under one of these directories, after all
+// symbolic links are resolved, so that callers cannot stream anything else the
+// process is able to read.
+//
+// © 2023 by Gwyneth Llewelyn. All rights reserved.
+// Licensed under a MIT License (see https://gwyneth-llewelyn.mit-license.org/).
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// Returned when a file is not under any of the allowed media roots.
+var errOutsideMediaRoots = errors.New("file is outside the allowed media roots")
+
+var (
+	mediaRootsList setting[string]	// comma-separated list of allowed roots, as set on the command line.
+	mediaRoots setting[[]string]	// canonical (absolute, symlink-free) allowed roots.
+	mediaRootPaths setting[[]string]	// the same roots, absolute, but as configured, i.e. with symlinks unresolved.
+)
+
+// canonicalPath makes a path absolute, cleans it up, and resolves all symbolic links.
+// The path must exist.
+func canonicalPath(path string) (string, error) {
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	return filepath.EvalSymlinks(absPath)
+}
+
+// configureMediaRoots sets the allowed media roots from a comma-separated list;
+// if empty, the media directory is the only allowed root.
+// Roots that don't exist are skipped with a warning.
+func configureMediaRoots(list string) error {
+	var roots, paths []string
+	if strings.TrimSpace(list) == "" {
+		list = mediaDirectory.Get()
+	}
+	for _, root := range strings.Split(list, ",") {
+		if root = strings.TrimSpace(root); root == "" {
+			continue
+		}
+		expanded, err := expandPath(root)
+		if err != nil {
+			logme.Warnf("media root %q cannot be expanded (%s), skipping\n", root, err)
+			continue
+		}
+		canonical, err := canonicalPath(expanded)
+		if err != nil {
+			logme.Warnf("media root %q cannot be resolved (%s), skipping\n", root, err)
+			continue
+		}
+		roots = append(roots, canonical)
+		paths = append(paths, filepath.Clean(absPath(expanded)))
+	}
+	if len(roots) == 0 {
+		return fmt.Errorf("no valid media roots found in %q", list)
+	}
+	mediaRoots.Set(roots)
+	mediaRootPaths.Set(paths)
+	logme.Infof("allowed media roots: %q\n", roots)
+	return nil
+}
+
+// resolveMediaFile turns a filename sent by a client into a canonical path under one of
+// the allowed media roots. Tildes are expanded, and relative paths are taken to be
+// relative to the first root; the result must still be inside an allowed root.
+// Anything not inside a root, as written, fails with errOutsideMediaRoots before the disk
+// is even looked at, so that callers can't find out which files exist elsewhere (nor which
+// users exist, with `~user`). Only if it is inside, and doesn't exist, the error wraps
+// fs.ErrNotExist.
+func resolveMediaFile(filename string) (string, error) {
+	roots := mediaRoots.Get()
+	if len(roots) == 0 {
+		return "", errOutsideMediaRoots
+	}
+	expanded, err := expandPath(filename)
+	if err != nil {
+		logme.Debugf("%q not properly expanded: %s\n", filename, err)
+		return "", errOutsideMediaRoots
+	}
+	if !filepath.IsAbs(expanded) {
+		expanded = filepath.Join(roots[0], expanded)
+	}
+	expanded = filepath.Clean(absPath(expanded))
+	if !insideMediaRoots(expanded) && !insideAny(mediaRootPaths.Get(), expanded) {
+		return "", errOutsideMediaRoots
+	}
+	canonical, err := canonicalPath(expanded)
+	if err != nil {
+		return "", err
+	}
+	if !insideMediaRoots(canonical) {
+		return "", errOutsideMediaRoots
+	}
+	return canonical, nil
+}
+
+// insideMediaRoots checks if a path is under any of the allowed roots.
+func insideMediaRoots(path string) bool {
+	return insideAny(mediaRoots.Get(), path)
+}
+
+// insideAny checks if a path is under any of the directories.
+func insideAny(dirs []string, path string) bool {
+	for _, dir := range dirs {
+		if insideDirectory(dir, path) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,123 @@
+// Which files are media, and which are album covers.
+// Audio, video and cover image extensions are configurable, and matched exactly (but
+// case-insensitively); the album cover of a directory is chosen from its images according
+// to a priority list of file name patterns.
+//
+// © 2023 by Gwyneth Llewelyn. All rights reserved.
+// Licensed under a MIT License (see https://gwyneth-llewelyn.mit-license.org/).
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var (
+	audioExtensionsList	setting[string]	// comma-separated audio extensions, as set on the command line.
+	videoExtensionsList	setting[string]	// comma-separated video extensions; these are streamed by ffmpeg, not VLC.
+	coverExtensionsList	setting[string]	// comma-separated image extensions for album covers.
+	coverNamesList		setting[string]	// comma-separated cover file name patterns, by order of priority.
+
+	audioExtensions		setting[map[string]bool]	// lowercase, with the leading dot; never changed once set.
+	videoExtensions		setting[map[string]bool]
+	coverExtensions		setting[map[string]bool]
+	coverNames			setting[[]string]			// lowercase patterns, as for filepath.Match().
+)
+
+// Defaults for the above.
+const (
+	defaultAudioExtensions	= ".mp3,.m4a,.aac"
+	defaultVideoExtensions	= ".mp4,.mkv,.webm,.mov"
+	defaultCoverExtensions	= ".jpg,.jpeg,.png,.gif,.heic,.webp"
+	defaultCoverNames		= "cover.*,folder.*,AlbumArt*Large*"
+)
+
+// configureMediaTypes parses the extension and cover name lists.
+// Invalid cover name patterns are skipped with a warning.
+func configureMediaTypes() {
+	audio := parseExtensions(audioExtensionsList.Get())
+	video := parseExtensions(videoExtensionsList.Get())
+	var names []string
+	for _, pattern := range strings.Split(coverNamesList.Get(), ",") {
+		if pattern = strings.ToLower(strings.TrimSpace(pattern)); pattern == "" {
+			continue
+		}
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			logme.Warnf("invalid cover name pattern %q (%s), skipping\n", pattern, err)
+			continue
+		}
+		names = append(names, pattern)
+	}
+	audioExtensions.Set(audio)
+	videoExtensions.Set(video)
+	coverExtensions.Set(parseExtensions(coverExtensionsList.Get()))
+	coverNames.Set(names)
+	if len(audio) + len(video) == 0 {
+		logme.Warnln("no audio or video extensions configured; no media files will be found")
+	}
+	logme.Debugf("audio: %q, video: %q, covers: %q, cover names: %q\n",
+		audioExtensionsList.Get(), videoExtensionsList.Get(), coverExtensionsList.Get(), names)
+}
+
+// parseExtensions turns a comma-separated list of extensions, with or without the leading
+// dot, into a set.
+func parseExtensions(list string) map[string]bool {
+	extensions := make(map[string]bool)
+	for _, ext := range strings.Split(list, ",") {
+		if ext = strings.ToLower(strings.TrimSpace(ext)); ext != "" && ext != "." {
+			extensions["." + strings.TrimPrefix(ext, ".")] = true
+		}
+	}
+	return extensions
+}
+
+// hasExtension checks the extension of a file against a set. Files without an extension
+// never match.
+func hasExtension(path string, extensions map[string]bool) bool {
+	ext := strings.ToLower(filepath.Ext(path))
+	return ext != "" && extensions[ext]
+}
+
+// isMediaFile checks if a file has one of the audio or video extensions.
+func isMediaFile(path string) bool {
+	return hasExtension(path, audioExtensions.Get()) || hasExtension(path, videoExtensions.Get())
+}
+
+// isVideoFile checks if a file has one of the video extensions.
+func isVideoFile(path string) bool {
+	return hasExtension(path, videoExtensions.Get())
+}
+
+// isCoverFile checks if a file is an image that might be the album cover for its directory.
+func isCoverFile(path string) bool {
+	return hasExtension(path, coverExtensions.Get())
+}
+
+// findCover picks the album cover among the images of a directory: the first one
+// (alphabetically) matching the first cover name pattern that matches anything, or else
+// the first image found. It returns the path to the image, or an empty string if there is none.
+func findCover(dir string) string {
+	entries, err := os.ReadDir(dir)	// sorted by name.
+	if err != nil {
+		logme.Debugf("cannot look for covers on %q: %s\n", dir, err)
+		return ""
+	}
+	var images []string
+	for _, entry := range entries {
+		if !entry.IsDir() && isCoverFile(entry.Name()) {
+			images = append(images, entry.Name())
+		}
+	}
+	if len(images) == 0 {
+		return ""
+	}
+	for _, pattern := range coverNames.Get() {
+		for _, image := range images {
+			if matched, _ := filepath.Match(pattern, strings.ToLower(image)); matched {
+				return filepath.Join(dir, image)
+			}
+		}
+	}
+	return filepath.Join(dir, images[0])
+}
@@ -0,0 +1,396 @@
+// Registry of in-world objects allowed to talk to StreamDude.
+// Each object is identified by its UUID (sent by Second Life®/OpenSimulator on the
+// `X-SecondLife-Object-Key` header) and has its own PIN and list of allowed actions.
+//
+// © 2023 by Gwyneth Llewelyn. All rights reserved.
+// Licensed under a MIT License (see https://gwyneth-llewelyn.mit-license.org/).
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	bolt "go.etcd.io/bbolt"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Name of the bucket where registered objects are kept.
+var objectBucket = []byte("objects")
+
+// Actions that can be granted to an object. Their names match the API endpoints.
+var validActions = []string{"play", "stream", "delete"}
+
+// Errors returned by the object registry.
+var (
+	errObjectUnknown		= errors.New("object not registered")
+	errObjectWrongPIN		= errors.New("PIN does not match the registered object")
+	errObjectForbidden		= errors.New("action not allowed for this object")
+	errObjectNoRegistry		= errors.New("object registry not available")
+	errObjectKeyMissing		= errors.New("no object key; only registered objects may authenticate")
+)
+
+// RegisteredObject is an in-world object that may request tokens.
+type RegisteredObject struct {
+	ObjectKey string	`json:"objectKey" xml:"objectKey" form:"objectKey" binding:"required,uuid"`	// UUID of the in-world object.
+	Owner string		`json:"owner" xml:"owner" form:"owner" binding:"omitempty,uuid"`				// UUID of the owner's avatar.
+	Name string			`json:"name,omitempty" xml:"name,omitempty" form:"name"`						// informative only.
+	PINHash string		`json:"-" xml:"-" form:"-"`													// bcrypt'ed PIN, never sent out.
+	Actions []string	`json:"actions" xml:"actions" form:"actions"`									// what the object can do (see validActions).
+	Created time.Time	`json:"created" xml:"created" form:"-"`
+}
+
+// storedObject is what actually goes into the database, since the PIN hash
+// is not supposed to be marshalled anywhere else.
+type storedObject struct {
+	RegisteredObject
+	PINHash string	`json:"pinHash"`
+}
+
+// decodeObject unmarshals a stored object.
+func decodeObject(v []byte) (*RegisteredObject, error) {
+	var s storedObject
+	if err := json.Unmarshal(v, &s); err != nil {
+		return nil, err
+	}
+	s.RegisteredObject.PINHash = s.PINHash
+	return &s.RegisteredObject, nil
+}
+
+// Allows checks if the object is allowed to perform a certain action.
+func (o *RegisteredObject) Allows(action string) bool {
+	return slices.Contains(o.Actions, action)
+}
+
+// checkPIN compares a PIN against the stored hash.
+func (o *RegisteredObject) checkPIN(pin string) error {
+	if err := bcrypt.CompareHashAndPassword([]byte(o.PINHash), []byte(pin)); err != nil {
+		return errObjectWrongPIN
+	}
+	return nil
+}
+
+// normaliseActions validates a list of actions (which may have comma-separated entries);
+// an empty list means all actions.
+func normaliseActions(actions []string) ([]string, error) {
+	var result []string
+	for _, entry := range actions {
+		for _, action := range strings.Split(entry, ",") {
+			action = strings.ToLower(strings.TrimSpace(action))
+			if action == "" {
+				continue
+			}
+			if !slices.Contains(validActions, action) {
+				return nil, fmt.Errorf("invalid action %q (valid actions are: %s)", action, strings.Join(validActions, ", "))
+			}
+			if !slices.Contains(result, action) {
+				result = append(result, action)
+			}
+		}
+	}
+	if len(result) == 0 {
+		result = slices.Clone(validActions)
+	}
+	return result, nil
+}
+
+// registerObject adds (or replaces) an object on the registry, hashing its PIN.
+func registerObject(o RegisteredObject, pin string) (*RegisteredObject, error) {
+	if db == nil {
+		return nil, errObjectNoRegistry
+	}
+	if err := validate.Var(o.ObjectKey, "required,uuid"); err != nil {
+		return nil, fmt.Errorf("invalid object key %q", o.ObjectKey)
+	}
+	if err := validate.Var(o.Owner, "omitempty,uuid"); err != nil {
+		return nil, fmt.Errorf("invalid owner key %q", o.Owner)
+	}
+	if err := validate.Var(pin, "required,number"); err != nil {
+		return nil, fmt.Errorf("PIN must be numeric")
+	}
+	var err error
+	if o.Actions, err = normaliseActions(o.Actions); err != nil {
+		return nil, err
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(pin), bcrypt.DefaultCost)
+	if err != nil {
+		return nil, err
+	}
+	o.ObjectKey = strings.ToLower(o.ObjectKey)
+	o.PINHash = string(hash)
+	o.Created = time.Now()
+
+	buf, err := json.Marshal(storedObject{RegisteredObject: o, PINHash: o.PINHash})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(objectBucket).Put([]byte(o.ObjectKey), buf)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &o, nil
+}
+
+// lookupObject retrieves a registered object by its key.
+func lookupObject(objectKey string) (*RegisteredObject, error) {
+	if db == nil {
+		return nil, errObjectNoRegistry
+	}
+	var o *RegisteredObject
+	err := db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(objectBucket).Get([]byte(strings.ToLower(objectKey)))
+		if v == nil {
+			return errObjectUnknown
+		}
+		var err error
+		o, err = decodeObject(v)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+// listObjects returns all registered objects, sorted by key.
+func listObjects() ([]RegisteredObject, error) {
+	if db == nil {
+		return nil, errObjectNoRegistry
+	}
+	var objects []RegisteredObject
+	err := db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(objectBucket).ForEach(func(k, v []byte) error {
+			o, err := decodeObject(v)
+			if err != nil {
+				return err
+			}
+			objects = append(objects, *o)
+			return nil
+		})
+	})
+	return objects, err
+}
+
+// removeObject deletes an object from the registry.
+func removeObject(objectKey string) error {
+	if db == nil {
+		return errObjectNoRegistry
+	}
+	return db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(objectBucket)
+		key := []byte(strings.ToLower(objectKey))
+		if bucket.Get(key) == nil {
+			return errObjectUnknown
+		}
+		return bucket.Delete(key)
+	})
+}
+
+// authenticateObject checks the PIN sent by an object.
+// With the database open, only registered objects get in, each with its own PIN; without it,
+// there's no registry, so the best we can do is to check the global LSL signature PIN.
+func authenticateObject(objectKey, pin string) error {
+	if db == nil {
+		if pin != lslSignaturePIN.Get() {
+			return errObjectWrongPIN
+		}
+		return nil
+	}
+	if objectKey == "" {
+		return errObjectKeyMissing
+	}
+	o, err := lookupObject(objectKey)
+	if err != nil {
+		return err
+	}
+	return o.checkPIN(pin)
+}
+
+// authoriseObject checks if the object that got a token may use it for `action`.
+// Without the database, tokens (see authenticateObject) can do everything; with it, only
+// registered objects may do what they're allowed to.
+func authoriseObject(objectKey, action string) error {
+	if db == nil {
+		return nil
+	}
+	if objectKey == "" {
+		return errObjectForbidden
+	}
+	o, err := lookupObject(objectKey)
+	if err != nil {
+		return err
+	}
+	if !o.Allows(action) {
+		return errObjectForbidden
+	}
+	return nil
+}
+
+/*
+ *  Command-line administration
+ */
+
+// objectsCommand implements the `objects` subcommand:
+//
+//	StreamDude [flags] objects add <objectKey> <ownerKey> <PIN> [actions...]
+//	StreamDude [flags] objects list
+//	StreamDude [flags] objects remove <objectKey>
+//
+// Returns the exit code.
+func objectsCommand(args []string) int {
+	usage := func() int {
+		fmt.Fprintf(os.Stderr, "usage: %s [flags] objects add <objectKey> <ownerKey> <PIN> [actions...]\n" +
+			"       %[1]s [flags] objects list\n" +
+			"       %[1]s [flags] objects remove <objectKey>\n" +
+			"valid actions: %s (default: all)\n", os.Args[0], strings.Join(validActions, ","))
+		return 2
+	}
+	if len(args) == 0 {
+		return usage()
+	}
+	switch args[0] {
+		case "add":
+			if len(args) < 4 {
+				return usage()
+			}
+			o, err := registerObject(RegisteredObject{ObjectKey: args[1], Owner: args[2], Actions: args[4:]}, args[3])
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "could not add object:", err)
+				return 1
+			}
+			fmt.Printf("object %s registered for owner %s, actions: %s\n", o.ObjectKey, o.Owner, strings.Join(o.Actions, ","))
+		case "list":
+			objects, err := listObjects()
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "could not list objects:", err)
+				return 1
+			}
+			w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+			fmt.Fprintln(w, "OBJECT KEY\tOWNER\tACTIONS\tCREATED")
+			for _, o := range objects {
+				fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", o.ObjectKey, o.Owner, strings.Join(o.Actions, ","), o.Created.Format(time.RFC3339))
+			}
+			w.Flush()
+		case "remove", "rm", "delete":
+			if len(args) != 2 {
+				return usage()
+			}
+			if err := removeObject(args[1]); err != nil {
+				fmt.Fprintln(os.Stderr, "could not remove object:", err)
+				return 1
+			}
+			fmt.Printf("object %s removed\n", args[1])
+		default:
+			return usage()
+	}
+	return 0
+}
+
+/*
+ *  Administration API
+ */
+
+// adminKey protects the administration API; if empty, the API is disabled.
+var adminKey setting[string]
+
+// requireAdmin is a middleware that checks the admin key, sent either on the
+// `X-StreamDude-Admin-Key` header or as the `adminKey` query/form field.
+func requireAdmin(c *gin.Context) {
+	if adminKey.Get() == "" {
+		checkErrReply(c, http.StatusForbidden, "admin", fmt.Errorf("administration API is disabled (no admin key configured)"))
+		return
+	}
+	sent := c.GetHeader("X-StreamDude-Admin-Key")
+	if sent == "" {
+		sent = c.Request.FormValue("adminKey")
+	}
+	// constant-time, so that the key can't be guessed from how long it takes to be rejected.
+	if subtle.ConstantTimeCompare([]byte(sent), []byte(adminKey.Get())) != 1 {
+		checkErrReply(c, http.StatusForbidden, "admin", fmt.Errorf("invalid admin key"))
+		return
+	}
+	c.Next()
+}
+
+// objectRequest is what /api/objects expects when adding a new object.
+type objectRequest struct {
+	RegisteredObject
+	PIN string	`json:"pin" xml:"pin" form:"pin" binding:"required,number"`
+}
+
+// apiListObjects handles GET /api/objects.
+func apiListObjects(c *gin.Context) {
+	objects, err := listObjects()
+	if err != nil {
+		checkErrReply(c, http.StatusInternalServerError, "objects: could not list objects", err)
+		return
+	}
+	switch getContentType(c) {
+		case binding.MIMEXML, "application/soap+xml", binding.MIMEXML2:
+			c.XML(http.StatusOK, gin.H{"status": "ok", "objects": objects})
+		case binding.MIMEPlain:
+			var sb strings.Builder
+			for _, o := range objects {
+				fmt.Fprintf(&sb, "%s %s %s\n", o.ObjectKey, o.Owner, strings.Join(o.Actions, ","))
+			}
+			c.String(http.StatusOK, sb.String())
+		default:
+			c.JSON(http.StatusOK, gin.H{"status": "ok", "objects": objects})
+	}
+}
+
+// apiAddObject handles POST /api/objects.
+func apiAddObject(c *gin.Context) {
+	var req objectRequest
+	if err := c.ShouldBind(&req); err != nil {
+		checkErrReply(c, http.StatusBadRequest, "objects: invalid object", err)
+		return
+	}
+	o, err := registerObject(req.RegisteredObject, req.PIN)
+	if err != nil {
+		checkErrReply(c, http.StatusBadRequest, "objects: could not register object", err)
+		return
+	}
+	logme.Infof("object %s registered for owner %q (actions: %v)\n", o.ObjectKey, o.Owner, o.Actions)
+	switch getContentType(c) {
+		case binding.MIMEXML, "application/soap+xml", binding.MIMEXML2:
+			c.XML(http.StatusCreated, gin.H{"status": "ok", "object": o})
+		case binding.MIMEPlain:
+			c.String(http.StatusCreated, "ADDED: " + o.ObjectKey)
+		default:
+			c.JSON(http.StatusCreated, gin.H{"status": "ok", "object": o})
+	}
+}
+
+// apiRemoveObject handles DELETE /api/objects/:key.
+func apiRemoveObject(c *gin.Context) {
+	objectKey := c.Param("key")
+	if err := removeObject(objectKey); err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, errObjectUnknown) {
+			status = http.StatusNotFound
+		}
+		checkErrReply(c, status, "objects: could not remove object", err)
+		return
+	}
+	logme.Infof("object %s removed from registry\n", objectKey)
+	switch getContentType(c) {
+		case binding.MIMEXML, "application/soap+xml", binding.MIMEXML2:
+			c.XML(http.StatusOK, gin.H{"status": "ok", "message": "object " + objectKey + " removed"})
+		case binding.MIMEPlain:
+			c.String(http.StatusOK, "REMOVED: " + objectKey)
+		default:
+			c.JSON(http.StatusOK, gin.H{"status": "ok", "message": "object " + objectKey + " removed"})
+	}
+}
@@ -0,0 +1,186 @@
+// Remote control for the playlist player.
+// The player itself is long-lived, so that it can be driven by the API while a
+// playlist is being streamed; see vlc-streaming.go for the actual implementation (or
+// vlc-fallback.go, on builds without libVLC),
+// ffmpeg-player.go for the one used for playlists with videos, and gapless-player.go for
+// the one streaming a whole playlist as a single, continuous, audio stream.
+//
+// © 2023 by Gwyneth Llewelyn. All rights reserved.
+// Licensed under a MIT License (see https://gwyneth-llewelyn.mit-license.org/).
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+)
+
+var (
+	errPlayerBusy	= errors.New("player is already streaming a playlist; stop it first")
+	errPlayerIdle	= errors.New("player is not streaming anything")
+)
+
+// PlaylistPlayer is implemented by everything that is able to stream a whole playlist.
+type PlaylistPlayer interface {
+	// Play starts streaming the checked items on the playlist, returning as soon as it starts.
+	Play(items []PlayListItem) error
+	Stop() error
+	Pause() error
+	Resume() error
+	Next() error
+	Previous() error
+	// Seek jumps to a position on the current track.
+	Seek(position time.Duration) error
+	// SetVolume sets the volume, in percent (0-100, but some players allow more).
+	SetVolume(volume int) error
+	Status() PlayerStatus
+}
+
+// PlayerStatus reports what the player is doing.
+type PlayerStatus struct {
+	Active bool		`json:"active" xml:"active"`					// a playlist is loaded.
+	Playing bool	`json:"playing" xml:"playing"`					// false if paused or idle.
+	Track int		`json:"track" xml:"track"`						// index of the current track (zero-based); -1 if unknown.
+	Tracks int		`json:"tracks" xml:"tracks"`					// number of tracks on the playlist.
+	File string		`json:"file,omitempty" xml:"file,omitempty"`	// current track.
+	Position int64	`json:"position" xml:"position"`				// position on the current track, in milliseconds.
+	Length int64	`json:"length" xml:"length"`					// length of the current track, in milliseconds.
+	Volume int		`json:"volume" xml:"volume"`
+	TrackChanges int		`json:"trackChanges" xml:"trackChanges"`						// track changes since the playlist started; clients compare it to the last one seen.
+	TrackStarted *time.Time	`json:"trackStarted,omitempty" xml:"trackStarted,omitempty"`	// when the current track started; nil (and left out) if unknown.
+	Job string		`json:"job,omitempty" xml:"job,omitempty"`	// ffmpeg job streaming the current track, if any (see jobs.go).
+	HLS string		`json:"hls,omitempty" xml:"hls,omitempty"`	// where to watch, if streaming via HLS (see hls.go).
+}
+
+// String is mostly used for plain-text replies.
+func (s PlayerStatus) String() string {
+	if !s.Active {
+		return "idle"
+	}
+	state := "paused"
+	if s.Playing {
+		state = "playing"
+	}
+	return fmt.Sprintf("%s %d/%d %s %s/%s vol:%d changes:%d", state, s.Track+1, s.Tracks, s.File,
+		time.Duration(s.Position) * time.Millisecond, time.Duration(s.Length) * time.Millisecond, s.Volume, s.TrackChanges)
+}
+
+// The one and only playlist player (for audio; see videoPlayer for videos).
+var mediaPlayer PlaylistPlayer
+
+// players returns all the players, the default one (driving libVLC, if built with it) being last.
+func players() []PlaylistPlayer {
+	return []PlaylistPlayer{videoPlayer, continuousPlayer, mediaPlayer}
+}
+
+// activePlayer returns whichever player is streaming something, so that it can be controlled.
+func activePlayer() PlaylistPlayer {
+	for _, player := range players() {
+		if player.Status().Active {
+			return player
+		}
+	}
+	return mediaPlayer
+}
+
+// playerRequest is what the player control API expects.
+type playerRequest struct {
+	Token string			`json:"token" xml:"token" form:"token"`
+	Position *float64		`json:"position" xml:"position" form:"position" binding:"omitempty,min=0"`	// seconds, for seek.
+	Volume *int				`json:"volume" xml:"volume" form:"volume" binding:"omitempty,min=0,max=200"`	// percent, for volume.
+}
+
+/*
+ *  Router functions
+ */
+
+// apiPlayerStatus handles GET /api/player.
+func apiPlayerStatus(c *gin.Context) {
+	if checkToken(c, "stream", tokenFromRequest(c)) == nil {
+		return
+	}
+	replyPlayerStatus(c, "player status")
+}
+
+// apiPlayerControl returns a handler for POST /api/player/<action>.
+func apiPlayerControl(action string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req playerRequest
+		if err := c.ShouldBind(&req); err != nil {
+			checkErrReply(c, http.StatusBadRequest, "player: " + action, err)
+			return
+		}
+		if req.Token == "" {
+			req.Token = c.GetHeader("X-StreamDude-Token")
+		}
+		if checkToken(c, "stream", req.Token) == nil {
+			return
+		}
+
+		var err error
+		player := activePlayer()
+		switch action {
+			case "stop":
+				err = player.Stop()
+			case "pause":
+				err = player.Pause()
+			case "resume":
+				err = player.Resume()
+			case "next":
+				err = player.Next()
+			case "previous":
+				err = player.Previous()
+			case "seek":
+				if req.Position == nil {
+					err = fmt.Errorf("missing position (in seconds)")
+					break
+				}
+				err = player.Seek(time.Duration(*req.Position * float64(time.Second)))
+			case "volume":
+				if req.Volume == nil {
+					err = fmt.Errorf("missing volume (in percent)")
+					break
+				}
+				err = player.SetVolume(*req.Volume)
+			default:
+				err = fmt.Errorf("unknown player action %q", action)
+		}
+		if err != nil {
+			status := http.StatusBadRequest
+			if errors.Is(err, errPlayerIdle) {
+				status = http.StatusConflict
+			} else if errors.Is(err, errNotSupported) {
+				status = http.StatusNotImplemented
+			}
+			checkErrReply(c, status, "player: " + action, err)
+			return
+		}
+		logme.Infof("player: %s\n", action)
+		replyPlayerStatus(c, action + " ok")
+	}
+}
+
+// replyPlayerStatus sends the current player status back, in whatever format was requested.
+func replyPlayerStatus(c *gin.Context, message string) {
+	status := activePlayer().Status()
+	switch getContentType(c) {
+		case binding.MIMEJSON:
+			c.JSON(http.StatusOK, gin.H{"status": "ok", "message": message, "player": status})
+		case binding.MIMEHTML, binding.MIMEPOSTForm, binding.MIMEMultipartPOSTForm:
+			c.HTML(http.StatusOK, "generic.tpl", environment(c, gin.H{
+				"Title"			: "Player",
+				"description"	: message,
+				"Text"			: message + ": " + status.String(),
+			}))
+		case binding.MIMEXML, "application/soap+xml", binding.MIMEXML2:
+			c.XML(http.StatusOK, gin.H{"status": "ok", "message": message, "player": status})
+		case binding.MIMEPlain:
+			fallthrough
+		default:
+			c.String(http.StatusOK, status.String())
+	}
+}
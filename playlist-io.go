@@ -0,0 +1,347 @@
+// Import and export of playlists, in M3U/M3U8 and XSPF formats.
+// Entries are always written relative to the media directory, and, when imported,
+// resolved relative to it; anything outside the media directory is rejected.
+//
+// © 2023 by Gwyneth Llewelyn. All rights reserved.
+// Licensed under a MIT License (see https://gwyneth-llewelyn.mit-license.org/).
+package main
+
+import (
+	"bufio"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/karrick/godirwalk"
+)
+
+// Maximum size of a playlist file we're willing to import.
+const maxPlaylistFileSize = 4 << 20
+
+// Supported playlist formats, with their MIME types.
+var playlistFormats = map[string]string{
+	"m3u":	"audio/x-mpegurl",
+	"m3u8":	"audio/x-mpegurl; charset=utf-8",
+	"xspf":	"application/xspf+xml",
+}
+
+// playlistFileEntry is a single entry read from a playlist file.
+type playlistFileEntry struct {
+	Location string			// as found on the file.
+	URI bool				// Location is a URI (as on XSPF), not a path (as on M3U).
+	Title string
+	Duration time.Duration	// zero if unknown.
+}
+
+// XSPF structures; see https://xspf.org/spec
+type xspfPlaylist struct {
+	XMLName xml.Name	`xml:"http://xspf.org/ns/0/ playlist"`
+	Version string		`xml:"version,attr"`
+	Title string		`xml:"title,omitempty"`
+	Tracks []xspfTrack	`xml:"trackList>track"`
+}
+
+type xspfTrack struct {
+	Location string		`xml:"location"`
+	Title string		`xml:"title,omitempty"`
+	Creator string		`xml:"creator,omitempty"`
+	Album string		`xml:"album,omitempty"`
+	Duration int64		`xml:"duration,omitempty"`	// in milliseconds.
+}
+
+// relativeToMedia returns the path of a playlist item relative to the media directory,
+// using forward slashes, as expected by playlist files.
+func relativeToMedia(item PlayListItem) string {
+	absMedia, err1 := filepath.Abs(mediaDirectory.Get())
+	absItem, err2 := filepath.Abs(item.Name())
+	if err1 == nil && err2 == nil {
+		if rel, err := filepath.Rel(absMedia, absItem); err == nil && insideDirectory(absMedia, absItem) {
+			return filepath.ToSlash(rel)
+		}
+	}
+	return filepath.ToSlash(item.Name())
+}
+
+// writeM3U writes an extended M3U playlist.
+func writeM3U(w io.Writer, name string, items []PlayListItem) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintln(bw, "#EXTM3U")
+	if name != "" {
+		fmt.Fprintf(bw, "#PLAYLIST:%s\n", name)
+	}
+	for _, item := range items {
+		seconds := -1	// -1 means unknown, as per the (informal) spec.
+		if item.Duration() > 0 {
+			seconds = int(item.Duration().Round(time.Second).Seconds())
+		}
+		title := item.Title()
+		if item.Artist() != "" {
+			title = item.Artist() + " - " + title
+		}
+		fmt.Fprintf(bw, "#EXTINF:%d,%s\n%s\n", seconds, title, relativeToMedia(item))
+	}
+	return bw.Flush()
+}
+
+// writeXSPF writes an XSPF playlist.
+func writeXSPF(w io.Writer, name string, items []PlayListItem) error {
+	pl := xspfPlaylist{Version: "1", Title: name}
+	for _, item := range items {
+		// String, unlike EscapedPath, makes sure that colons aren't mistaken for a scheme.
+		location := (&url.URL{Path: relativeToMedia(item)}).String()
+		pl.Tracks = append(pl.Tracks, xspfTrack{
+			Location:	location,
+			Title:		item.Title(),
+			Creator:	item.Artist(),
+			Album:		item.Album(),
+			Duration:	item.Duration().Milliseconds(),
+		})
+	}
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "\t")
+	return enc.Encode(pl)
+}
+
+// readM3U parses a (possibly extended) M3U playlist.
+func readM3U(r io.Reader) (name string, entries []playlistFileEntry, err error) {
+	scanner := bufio.NewScanner(r)
+	var pending playlistFileEntry
+	for scanner.Scan() {
+		line := strings.TrimSpace(strings.TrimPrefix(scanner.Text(), "\ufeff"))
+		switch {
+			case line == "":
+				continue
+			case strings.HasPrefix(line, "#EXTINF:"):
+				// #EXTINF:<seconds>[ attributes],<title>
+				info, title, _ := strings.Cut(strings.TrimPrefix(line, "#EXTINF:"), ",")
+				if fields := strings.Fields(info); len(fields) > 0 {
+					if seconds, err := strconv.ParseFloat(fields[0], 64); err == nil && seconds > 0 {
+						pending.Duration = time.Duration(seconds * float64(time.Second))
+					}
+				}
+				pending.Title = strings.TrimSpace(title)
+			case strings.HasPrefix(line, "#PLAYLIST:"):
+				name = strings.TrimSpace(strings.TrimPrefix(line, "#PLAYLIST:"))
+			case strings.HasPrefix(line, "#"):
+				// other directives and comments are ignored.
+				continue
+			default:
+				pending.Location = line
+				entries = append(entries, pending)
+				pending = playlistFileEntry{}
+		}
+	}
+	return name, entries, scanner.Err()
+}
+
+// readXSPF parses an XSPF playlist.
+func readXSPF(r io.Reader) (name string, entries []playlistFileEntry, err error) {
+	var pl xspfPlaylist
+	if err = xml.NewDecoder(r).Decode(&pl); err != nil {
+		return "", nil, err
+	}
+	for _, track := range pl.Tracks {
+		entries = append(entries, playlistFileEntry{
+			Location:	strings.TrimSpace(track.Location),
+			URI:		true,
+			Title:		track.Title,
+			Duration:	time.Duration(track.Duration) * time.Millisecond,
+		})
+	}
+	return pl.Title, entries, nil
+}
+
+// resolvePlaylistEntry converts a location found on a playlist file into a path inside
+// the media directory, rejecting anything that points elsewhere.
+// XSPF locations are URIs, and are always decoded; M3U entries are taken literally, as
+// paths, unless they are URLs (`file://`, the only kind supported, is decoded, too).
+func resolvePlaylistEntry(entry playlistFileEntry) (string, error) {
+	location := entry.Location
+	entryPath := location
+	u, err := url.Parse(location)
+	switch {
+		case entry.URI && err != nil:
+			return "", fmt.Errorf("%q is not a valid URI: %w", location, err)
+		case entry.URI || (err == nil && u.Scheme != "" && strings.HasPrefix(location[len(u.Scheme):], "://")):
+			if u.Scheme != "" && u.Scheme != "file" {
+				return "", fmt.Errorf("%q: only local files are supported", location)
+			}
+			entryPath = u.Path
+	}
+	entryPath = filepath.FromSlash(entryPath)
+	mediaDir := mediaDirectory.Get()
+	if !filepath.IsAbs(entryPath) {
+		entryPath = filepath.Join(mediaDir, entryPath)
+	}
+	if !insideDirectory(mediaDir, entryPath) {
+		return "", fmt.Errorf("%q is outside the media directory", location)
+	}
+	return filepath.Clean(entryPath), nil
+}
+
+// importPlaylist reads a playlist file in the given format, returning its name and items.
+func importPlaylist(r io.Reader, format string) (string, []PlayListItem, error) {
+	var (
+		name string
+		entries []playlistFileEntry
+		err error
+	)
+	r = io.LimitReader(r, maxPlaylistFileSize)
+	switch format {
+		case "m3u", "m3u8":
+			name, entries, err = readM3U(r)
+		case "xspf":
+			name, entries, err = readXSPF(r)
+		default:
+			err = fmt.Errorf("unsupported playlist format %q", format)
+	}
+	if err != nil {
+		return "", nil, err
+	}
+
+	items := make([]PlayListItem, 0, len(entries))
+	for _, entry := range entries {
+		entryPath, err := resolvePlaylistEntry(entry)
+		if err != nil {
+			return "", nil, err
+		}
+		fi, err := os.Stat(entryPath)
+		if err != nil {
+			return "", nil, fmt.Errorf("%q: %w", entry.Location, err)
+		}
+		if fi.IsDir() {
+			return "", nil, fmt.Errorf("%q is a directory", entry.Location)
+		}
+		de, err := godirwalk.NewDirent(entryPath)
+		if err != nil {
+			return "", nil, fmt.Errorf("%q: %w", entry.Location, err)
+		}
+		item := NewPlayListItem(*de, entryPath, "", fi.ModTime(), fi.Size(), true)
+		item.title = entry.Title
+		item.duration = entry.Duration
+		items = append(items, *item)
+	}
+	return name, items, nil
+}
+
+// playlistFormat figures out the format of a playlist file from its name.
+func playlistFormat(filename string) string {
+	return strings.TrimPrefix(strings.ToLower(filepath.Ext(filename)), ".")
+}
+
+/*
+ *  Router functions
+ */
+
+// exportPlaylist sends a playlist as a file download.
+func exportPlaylist(c *gin.Context, pl Playlist) {
+	format := strings.ToLower(c.DefaultQuery("format", "m3u8"))
+	contentType, ok := playlistFormats[format]
+	if !ok {
+		checkErrReply(c, http.StatusBadRequest, "export", fmt.Errorf("unsupported playlist format %q", format))
+		return
+	}
+	var items []PlayListItem
+	for _, item := range pl.Items {
+		if item.Checked() {
+			items = append(items, item)
+		}
+	}
+	filename := pl.ID + "." + format
+	c.Header("Content-Type", contentType)
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	c.Status(http.StatusOK)
+
+	var err error
+	if format == "xspf" {
+		err = writeXSPF(c.Writer, pl.Name, items)
+	} else {
+		err = writeM3U(c.Writer, pl.Name, items)
+	}
+	if err != nil {
+		logme.Errorf("could not export playlist %s: %s\n", pl.ID, err)
+	}
+}
+
+// apiExportPlaylist handles GET /api/playlists/:id/export?format=(m3u|m3u8|xspf).
+func apiExportPlaylist(c *gin.Context) {
+	token := checkToken(c, "stream", tokenFromRequest(c))
+	if token == nil {
+		return
+	}
+	pl, err := playlists.Get(c.Param("id"), requestOwners(c, token)...)
+	if err != nil {
+		checkErrReply(c, http.StatusNotFound, "export: " + c.Param("id"), err)
+		return
+	}
+	exportPlaylist(c, pl)
+}
+
+// uiExportPlaylist handles GET /ui/playlists/:id/export, for the download button;
+// only playlists belonging to the browser session can be exported this way.
+func uiExportPlaylist(c *gin.Context) {
+	pl, err := playlists.Get(c.Param("id"), sessionOwner(c))
+	if err != nil {
+		checkErrReply(c, http.StatusNotFound, "export: " + c.Param("id"), err)
+		return
+	}
+	exportPlaylist(c, pl)
+}
+
+// apiImportPlaylist handles POST /api/playlists/import.
+// The playlist comes either as a multipart upload (on the `playlist` field), or as the
+// raw request body, in which case its format must be passed on the `format` field.
+func apiImportPlaylist(c *gin.Context) {
+	token := checkToken(c, "stream", tokenFromRequest(c))
+	if token == nil {
+		return
+	}
+	var (
+		body io.Reader
+		format = strings.ToLower(c.Query("format"))
+		name = c.Request.FormValue("name")
+	)
+	if fileHeader, err := c.FormFile("playlist"); err == nil {
+		file, err := fileHeader.Open()
+		if err != nil {
+			checkErrReply(c, http.StatusBadRequest, "import: could not read upload", err)
+			return
+		}
+		defer file.Close()
+		body = file
+		if format == "" {
+			format = playlistFormat(fileHeader.Filename)
+		}
+		if name == "" {
+			name = strings.TrimSuffix(fileHeader.Filename, filepath.Ext(fileHeader.Filename))
+		}
+	} else {
+		body = c.Request.Body
+	}
+
+	plName, items, err := importPlaylist(body, format)
+	if err != nil {
+		checkErrReply(c, http.StatusBadRequest, "import: invalid playlist", err)
+		return
+	}
+	if name == "" {
+		name = plName
+	}
+	if name == "" {
+		name = "Imported playlist"
+	}
+	pl := playlists.Create(name, tokenOwner(token), items)
+	logme.Infof("playlist %s (%q) imported with %d items\n", pl.ID, pl.Name, len(pl.Items))
+	replyPlaylist(c, http.StatusCreated, pl)
+}
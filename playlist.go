@@ -8,15 +8,23 @@ package main
 
 import (
 //	"io/fs"
+	"errors"
+	"fmt"
+	"net/http"
 	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/dchest/uniuri"
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
 	"github.com/karrick/godirwalk"
 )
 
-const validExtensions		= ".mp3.m4a.aac"				// valid audio extensions, add more if needed.
-const validCoverExtensions	= ".jpg.jpeg.png.gif.heic.webp"	// valid image extensions for album cover, add more if needed.
-
 // Represents a playlist item, including image, checkbox status etc.
 type PlayListItem struct {
 	de godirwalk.Dirent	// directory entry data retrieved from godirwalk.
@@ -26,6 +34,11 @@ type PlayListItem struct {
 	modTime time.Time	`validate:"datetime"`			// last modified date (at least on Unix-like systems).
 	size int64			// filesize in bytes, as reported by the system.
 	checked bool		// file checkbox enabled; eventually this will add the file to the playlist.
+	title string		// track title, if known (e.g. from an imported playlist).
+	duration time.Duration	// track duration, if known; zero otherwise.
+	info *MediaInfo		// set after probing; nil if not probed (yet).
+	unplayable bool		// probing failed, so this won't be streamed.
+	tags *Tags			// ID3v2/MP4 tags, if any.
 }
 
 // Given a godirwalk.Dirent, tries to assembly a valid playlist item.
@@ -55,6 +68,74 @@ func (p PlayListItem) String() string {
 	return p.fullPath
 }
 
+// Track title; if unknown, the file name without the extension.
+// Directories just use their name.
+func (p PlayListItem) Title() string {
+	if p.title != "" {
+		return p.title
+	}
+	if p.IsDir() {
+		return filepath.Base(p.fullPath)
+	}
+	if p.tags != nil && p.tags.Title != "" {
+		return p.tags.Title
+	}
+	base := filepath.Base(p.fullPath)
+	return strings.TrimSuffix(base, filepath.Ext(base))
+}
+
+// Metadata tags read from the file; nil if there are none.
+func (p PlayListItem) Tags() *Tags {
+	return p.tags
+}
+
+// Artist, from the tags; empty if unknown.
+func (p PlayListItem) Artist() string {
+	if p.tags == nil {
+		return ""
+	}
+	return p.tags.Artist
+}
+
+// Album, from the tags; empty if unknown.
+func (p PlayListItem) Album() string {
+	if p.tags == nil {
+		return ""
+	}
+	return p.tags.Album
+}
+
+// Track duration; zero if unknown.
+func (p PlayListItem) Duration() time.Duration {
+	return p.duration
+}
+
+// Media information, as found by ffprobe; nil if the item wasn't probed.
+func (p PlayListItem) Info() *MediaInfo {
+	return p.info
+}
+
+// IsVideo is true for video files, unless probing found no video stream on them.
+func (p PlayListItem) IsVideo() bool {
+	if p.info != nil {
+		return p.info.VideoCodec != ""
+	}
+	return isVideoFile(p.fullPath)
+}
+
+// Playable is false only if probing found nothing to stream.
+func (p PlayListItem) Playable() bool {
+	return !p.unplayable
+}
+
+// setMediaInfo saves the results of probing, including the duration (unless already known).
+func (p *PlayListItem) setMediaInfo(info MediaInfo) {
+	p.info = &info
+	if p.duration == 0 {
+		p.duration = info.Length()
+	}
+}
+
 // Album cover image file.
 func (p PlayListItem) Cover() string {
 	return p.cover
@@ -109,6 +190,34 @@ func (p PlayListItem) ModeType() os.FileMode {
 	return p.de.ModeType()
 }
 
+// PlayListEntry is the public view of a playlist item, suitable for JSON/XML encoding.
+type PlayListEntry struct {
+	File string			`json:"file" xml:"file"`
+	Title string		`json:"title" xml:"title"`
+	Duration float64	`json:"duration,omitempty" xml:"duration,omitempty"`	// in seconds.
+	Cover string		`json:"cover,omitempty" xml:"cover,omitempty"`
+	Size int64			`json:"size" xml:"size"`
+	ModTime time.Time	`json:"modTime" xml:"modTime"`
+	Checked bool		`json:"checked" xml:"checked"`
+	Media *MediaInfo	`json:"media,omitempty" xml:"media,omitempty"`			// nil if not probed.
+	Tags *Tags			`json:"tags,omitempty" xml:"tags,omitempty"`			// nil if the file has none.
+}
+
+// Entry returns the public view of this item.
+func (p PlayListItem) Entry() PlayListEntry {
+	return PlayListEntry{
+		File:		p.fullPath,
+		Title:		p.Title(),
+		Duration:	p.duration.Seconds(),
+		Cover:		p.cover,
+		Size:		p.size,
+		ModTime:	p.modTime,
+		Checked:	p.checked,
+		Media:		p.info,
+		Tags:		p.tags,
+	}
+}
+
 // reset releases memory held by most of the struct (except the Dirent).
 func (p *PlayListItem) reset() {
 	// p.de.reset()	// no way to free memory from the Dirent!
@@ -117,10 +226,441 @@ func (p *PlayListItem) reset() {
 	p.modTime = time.Now()
 	p.size = 0
 	p.checked = false
+	p.title = ""
+	p.duration = 0
+	p.info = nil
+	p.unplayable = false
+	p.tags = nil
+}
+
+
+// folderCover returns the URL of the album cover for a directory (see findCover),
+// or an empty string if there is none.
+func folderCover(dir string) string {
+	coverFile := findCover(dir)
+	if coverFile == "" {
+		logme.Debugf("no cover image found on album at %q; no cover set\n", dir)
+		return ""
+	}
+	logme.Debugf("stat() found an album cover file for %q\n", dir)
+	return filepath.Join(urlPathPrefix, coverFile)
 }
 
+// walkMedia walks recursively through `root`, calling `found` for every valid audio file,
+// with its cover (if any) and FileInfo.
+// Directories reachable through more than one path (e.g. via symbolic links, possibly in
+// a loop) are only walked the first time.
+func walkMedia(root string, found func(path string, cover string, fi os.FileInfo)) error {
+	var lastCoverPath string			// 'cache' of the cover art for this directory (= album),
+	visited := make(map[string]bool)	// canonical paths of the directories already walked.
+
+	err := godirwalk.Walk(root,
+		&godirwalk.Options{
+			FollowSymbolicLinks: true,
+			Callback: func(osPathname string, de *godirwalk.Dirent) error {
+				// go one level deeper
+				isDir, dirErr := de.IsDirOrSymlinkToDir();
+				if isDir {
+					if dirErr == nil {
+						if canonical, err := filepath.EvalSymlinks(osPathname); err == nil {
+							if visited[canonical] {
+								logme.Debugf("skipping %q, already walked as %q\n", osPathname, canonical)
+								return godirwalk.SkipThis
+							}
+							visited[canonical] = true
+						}
+						logme.Debugf("entering %q (base name: %q)...\n", osPathname, de.Name())
+						// Check for a cover image; if there is none, embedded cover art may be used instead.
+						lastCoverPath = folderCover(osPathname)
+						return nil
+					}
+					logme.Errorf("error while trying to access directory/symlink %q: %s",
+						osPathname, dirErr)
+						return nil 	// or should we return godirwalk.SkipThis?
+				}
+
+				// FileInfo for the file currently being considered.
+				// We need it here because of scope issues. (gwyneth 20230828)
+				// var fiThis fs.FileInfo	// not needed any longer, actually, due to code refactoring.
+
+				// Check if this is a valid audio file, a possible album cover, or none of those.
+				// First, take a look at the extension. We need to make sure we actually get anything,
+				// since an empty extension "" will match *any* file, which is NOT what we want here!
+				fileExtension := strings.ToLower(filepath.Ext(osPathname))
+
+				// Note: the extension is just a first filter; files are probed later (see probe.go)
+				// to make sure they are actually playable.
+				if fileExtension != "" {
+					if isMediaFile(osPathname) {
+						// Ok, this is a valid audio file, so get the fileinfo for this entry:
+						fiThis, err := os.Stat(osPathname)
+						if err != nil {
+							logme.Errorf("stat() failed on file %s: %s\n", osPathname, err)
+							return err
+						}
+						// Note: we keep the filesystem path, since that's what gets streamed.
+						found(osPathname, lastCoverPath, fiThis)
+						// All clear, let's move on!
+						return nil
+					} else if isCoverFile(osPathname) {
+						// this is a potential album cover image, already considered by folderCover().
+						logme.Debugf("potential cover found: %q (using %q)\n", osPathname, lastCoverPath)
+						// Ok, no more processing on this file, we can skip the entry.
+						return godirwalk.SkipThis
+					}
+					// skip this file if not a valid audio file, nor a cover image:
+					logme.Debugf("skipping %q (extension found: %q)...\n", de.Name(), fileExtension)
+					return godirwalk.SkipThis
+				} else {
+					// Rare case where a file hasn't got an extension, so we cannot figure out what its type is.
+					logme.Debugf("empty file extension for %q, skipping...\n", de.Name())
+					return godirwalk.SkipThis
+				}
+			},	// ends Callback
+			ErrorCallback: func(osPathname string, err error) godirwalk.ErrorAction {
+				logme.Errorf("on file %s: %s\n", osPathname, err)
+				return godirwalk.SkipNode
+			},
+			// Called at the end of every directory, after all the children have been invoked.
+			PostChildrenCallback: func(osPathName string, de *godirwalk.Dirent) error {
+				logme.Debugf("finished with directory %q: emptying album cover path (%s)\n", osPathName, lastCoverPath)
+				lastCoverPath = ""
+				return nil
+			},
+			// Unsorted: false, // (optional) set true for faster yet non-deterministic enumeration (see godoc)
+	})	// end options for dirwalk
+	if err != nil {
+		logme.Errorf("sorry, walking through %q got error: %s\n", root, err)
+	}
+	return err
+}
+
+// selectItems picks the `files` (in that order) out of the scanned `items`, marking them as
+// checked for streaming. Files that were not scanned before are rejected.
+func selectItems(items []PlayListItem, files []string) ([]PlayListItem, error) {
+	byName := make(map[string]PlayListItem, len(items))
+	for _, item := range items {
+		byName[item.Name()] = item
+	}
+	selected := make([]PlayListItem, 0, len(files))
+	for _, file := range files {
+		item, ok := byName[file]
+		if !ok {
+			return nil, fmt.Errorf("%q is not part of this playlist", file)
+		}
+		if !item.Playable() {
+			return nil, fmt.Errorf("%q cannot be played", file)
+		}
+		item.checked = true
+		selected = append(selected, item)
+	}
+	return selected, nil
+}
+
+/*
+ *  Playlist store.
+ *  Playlists are kept server-side, each with its own ID and owner, so that different
+ *  users (or different in-world objects) don't overwrite each other's playlists.
+ */
+
+const (
+	maxPlaylistsPerOwner	= 20				// how many playlists each owner may have; the least recently used are discarded.
+	maxPlaylists			= 1000				// same, for everybody together, since anyone can become a new owner.
+	playlistExpiry			= 24 * time.Hour	// playlists not used for this long are discarded.
+)
+
+// Name of the cookie that identifies a browser session.
+const sessionCookie = "streamdude_session"
+
+// Playlist is a named list of items, belonging to someone.
+type Playlist struct {
+	ID string			`json:"id" xml:"id"`
+	Name string			`json:"name" xml:"name"`
+	Owner string		`json:"-" xml:"-"`					// see sessionOwner() and tokenOwner().
+	Created time.Time	`json:"created" xml:"created"`
+	LastUsed time.Time	`json:"lastUsed" xml:"lastUsed"`
+	Items []PlayListItem	`json:"-" xml:"-"`
+	scan bool										// made by browsing a directory; see Scan().
+}
+
+// PlaylistStore keeps all playlists in memory; it's safe for concurrent use.
+type PlaylistStore struct {
+	mu sync.RWMutex
+	playlists map[string]*Playlist
+}
+
+// Global playlist store.
+var playlists = NewPlaylistStore()
+
+// NewPlaylistStore returns an empty store.
+func NewPlaylistStore() *PlaylistStore {
+	return &PlaylistStore{playlists: make(map[string]*Playlist)}
+}
+
+// Create adds a new playlist, returning a copy of it.
+func (s *PlaylistStore) Create(name, owner string, items []PlayListItem) Playlist {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.add(name, owner, items, false)
+}
 
-// A series of valid playlist entries (only audio files).
-// This is allegedly constructed once, by the ui/stream handler, and reused here.
-// TODO(gwyneth): Or maybe put inside a Gin context?
-var playlist []PlayListItem
+// Scan is like Create, for the playlist of a directory being browsed: each owner keeps just
+// one of those, which gets replaced every time another directory is browsed.
+func (s *PlaylistStore) Scan(name, owner string, items []PlayListItem) Playlist {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, pl := range s.playlists {
+		if pl.scan && pl.Owner == owner {
+			pl.Name = name
+			pl.Items = slices.Clone(items)
+			pl.LastUsed = time.Now()
+			return pl.copy()
+		}
+	}
+	return s.add(name, owner, items, true)
+}
+
+// add does the actual work for Create and Scan. Must be called with the lock held.
+func (s *PlaylistStore) add(name, owner string, items []PlayListItem, scan bool) Playlist {
+	now := time.Now()
+	pl := &Playlist{
+		ID:			uniuri.NewLen(16),
+		Name:		name,
+		Owner:		owner,
+		Created:	now,
+		LastUsed:	now,
+		Items:		slices.Clone(items),
+		scan:		scan,
+	}
+	s.playlists[pl.ID] = pl
+	s.prune(owner)
+	return pl.copy()
+}
+
+// Get retrieves a copy of a playlist, if it belongs to one of the `owners`.
+func (s *PlaylistStore) Get(id string, owners ...string) (Playlist, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	pl, ok := s.playlists[id]
+	if !ok || !slices.Contains(owners, pl.Owner) {
+		// we don't tell apart playlists that don't exist from those belonging to someone else.
+		return Playlist{}, errPlaylistUnknown
+	}
+	pl.LastUsed = time.Now()
+	return pl.copy(), nil
+}
+
+// List returns copies of all playlists belonging to the `owners`, most recently used first.
+func (s *PlaylistStore) List(owners ...string) []Playlist {
+	s.mu.RLock()
+	var list []Playlist
+	for _, pl := range s.playlists {
+		if slices.Contains(owners, pl.Owner) {
+			list = append(list, pl.copy())
+		}
+	}
+	s.mu.RUnlock()
+	sort.Slice(list, func(a, b int) bool {
+		return list[a].LastUsed.After(list[b].LastUsed)
+	})
+	return list
+}
+
+// Delete removes a playlist, if it belongs to one of the `owners`.
+func (s *PlaylistStore) Delete(id string, owners ...string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	pl, ok := s.playlists[id]
+	if !ok || !slices.Contains(owners, pl.Owner) {
+		return errPlaylistUnknown
+	}
+	delete(s.playlists, id)
+	return nil
+}
+
+// prune discards expired playlists, and then the least recently used ones, first those of
+// an owner with too many, then any, if there are too many overall.
+// Must be called with the lock held.
+func (s *PlaylistStore) prune(owner string) {
+	var owned, all []*Playlist
+	for id, pl := range s.playlists {
+		if time.Since(pl.LastUsed) > playlistExpiry {
+			delete(s.playlists, id)
+			continue
+		}
+		if pl.Owner == owner {
+			owned = append(owned, pl)
+		}
+		all = append(all, pl)
+	}
+	leastRecentlyUsed := func(list []*Playlist, keep int) {
+		if len(list) <= keep {
+			return
+		}
+		sort.Slice(list, func(a, b int) bool {
+			return list[a].LastUsed.Before(list[b].LastUsed)
+		})
+		for _, pl := range list[:len(list)-keep] {
+			delete(s.playlists, pl.ID)
+		}
+	}
+	leastRecentlyUsed(owned, maxPlaylistsPerOwner)
+	if len(s.playlists) > maxPlaylists {
+		all = slices.DeleteFunc(all, func(pl *Playlist) bool {
+			_, ok := s.playlists[pl.ID]
+			return !ok
+		})
+		leastRecentlyUsed(all, maxPlaylists)
+	}
+}
+
+// copy returns a copy of the playlist that can be safely used outside the store.
+func (pl *Playlist) copy() Playlist {
+	c := *pl
+	c.Items = slices.Clone(pl.Items)
+	return c
+}
+
+var errPlaylistUnknown = errors.New("no such playlist")
+
+// sessionOwner identifies the browser session making the request, creating one if needed.
+func sessionOwner(c *gin.Context) string {
+	id, err := c.Cookie(sessionCookie)
+	if err != nil || id == "" {
+		id = uniuri.NewLen(24)
+		c.SetSameSite(http.SameSiteStrictMode)
+		c.SetCookie(sessionCookie, id, 0, urlPathPrefix, "", false, true)
+	}
+	return "session:" + id
+}
+
+// tokenOwner identifies whoever got a token: the in-world object, if there is one,
+// or else the token itself.
+func tokenOwner(t *Token) string {
+	if t.ObjectKey != "" {
+		return "object:" + t.ObjectKey
+	}
+	return "token:" + t.Token
+}
+
+// requestOwners returns all identities that the request may claim, given a validated token.
+func requestOwners(c *gin.Context, t *Token) []string {
+	owners := []string{tokenOwner(t)}
+	if id, err := c.Cookie(sessionCookie); err == nil && id != "" {
+		owners = append(owners, "session:" + id)
+	}
+	return owners
+}
+
+/*
+ *  Router functions
+ */
+
+// playlistRequest is what /api/playlists expects.
+type playlistRequest struct {
+	Token string	`json:"token" xml:"token" form:"token"`
+	Name string		`json:"name" xml:"name" form:"name" binding:"max=128"`
+}
+
+// apiListPlaylists handles GET /api/playlists, listing the caller's playlists.
+func apiListPlaylists(c *gin.Context) {
+	token := checkToken(c, "stream", tokenFromRequest(c))
+	if token == nil {
+		return
+	}
+	list := playlists.List(requestOwners(c, token)...)
+	switch getContentType(c) {
+		case binding.MIMEXML, "application/soap+xml", binding.MIMEXML2:
+			c.XML(http.StatusOK, gin.H{"status": "ok", "playlists": list})
+		case binding.MIMEPlain:
+			var sb strings.Builder
+			for _, pl := range list {
+				fmt.Fprintf(&sb, "%s %d %s\n", pl.ID, len(pl.Items), pl.Name)
+			}
+			c.String(http.StatusOK, sb.String())
+		default:
+			c.JSON(http.StatusOK, gin.H{"status": "ok", "playlists": list})
+	}
+}
+
+// apiCreatePlaylist handles POST /api/playlists, creating a new playlist from a scan of the media directory.
+func apiCreatePlaylist(c *gin.Context) {
+	var req playlistRequest
+	if err := c.ShouldBind(&req); err != nil {
+		checkErrReply(c, http.StatusBadRequest, "playlists: invalid request", err)
+		return
+	}
+	token := checkToken(c, "stream", req.Token)
+	if token == nil {
+		return
+	}
+	if !library.Scanned() {
+		if err := library.Rescan(mediaDirectory.Get()); err != nil && !errors.Is(err, errRescanRunning) {
+			checkErrReply(c, http.StatusInternalServerError, "playlists: could not scan " + mediaDirectory.Get(), err)
+			return
+		}
+	}
+	items := library.Items(mediaDirectory.Get())
+	if req.Name == "" {
+		req.Name = "Scan of " + mediaDirectory.Get()
+	}
+	pl := playlists.Create(req.Name, tokenOwner(token), items)
+	logme.Infof("playlist %s (%q) created with %d items\n", pl.ID, pl.Name, len(pl.Items))
+	replyPlaylist(c, http.StatusCreated, pl)
+}
+
+// apiGetPlaylist handles GET /api/playlists/:id.
+func apiGetPlaylist(c *gin.Context) {
+	token := checkToken(c, "stream", tokenFromRequest(c))
+	if token == nil {
+		return
+	}
+	pl, err := playlists.Get(c.Param("id"), requestOwners(c, token)...)
+	if err != nil {
+		checkErrReply(c, http.StatusNotFound, "playlists: " + c.Param("id"), err)
+		return
+	}
+	replyPlaylist(c, http.StatusOK, pl)
+}
+
+// apiDeletePlaylist handles DELETE /api/playlists/:id.
+func apiDeletePlaylist(c *gin.Context) {
+	token := checkToken(c, "stream", tokenFromRequest(c))
+	if token == nil {
+		return
+	}
+	if err := playlists.Delete(c.Param("id"), requestOwners(c, token)...); err != nil {
+		checkErrReply(c, http.StatusNotFound, "playlists: " + c.Param("id"), err)
+		return
+	}
+	switch getContentType(c) {
+		case binding.MIMEXML, "application/soap+xml", binding.MIMEXML2:
+			c.XML(http.StatusOK, gin.H{"status": "ok", "message": "playlist " + c.Param("id") + " deleted"})
+		case binding.MIMEPlain:
+			c.String(http.StatusOK, "DELETED: " + c.Param("id"))
+		default:
+			c.JSON(http.StatusOK, gin.H{"status": "ok", "message": "playlist " + c.Param("id") + " deleted"})
+	}
+}
+
+// replyPlaylist sends a playlist and its entries back.
+func replyPlaylist(c *gin.Context, httpStatus int, pl Playlist) {
+	entries := make([]PlayListEntry, 0, len(pl.Items))
+	for _, item := range pl.Items {
+		entries = append(entries, item.Entry())
+	}
+	switch getContentType(c) {
+		case binding.MIMEXML, "application/soap+xml", binding.MIMEXML2:
+			c.XML(httpStatus, gin.H{"status": "ok", "playlist": pl, "entries": entries})
+		case binding.MIMEPlain:
+			// first line is the ID, so that LSL scripts can easily grab it.
+			var sb strings.Builder
+			fmt.Fprintf(&sb, "%s\n", pl.ID)
+			for _, entry := range entries {
+				fmt.Fprintf(&sb, "%s\n", entry.File)
+			}
+			c.String(httpStatus, sb.String())
+		default:
+			c.JSON(httpStatus, gin.H{"status": "ok", "playlist": pl, "entries": entries})
+	}
+}
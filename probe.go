@@ -0,0 +1,221 @@
+// Media probing via ffprobe.
+// Files are probed before being streamed, to make sure they're actually playable, and
+// to learn their duration, container and codecs; results are cached per file, and
+// thrown away whenever the file changes.
+//
+// © 2023 by Gwyneth Llewelyn. All rights reserved.
+// Licensed under a MIT License (see https://gwyneth-llewelyn.mit-license.org/).
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	probeTimeout		= 15 * time.Second	// ffprobe should never take this long on a local file.
+	probeCacheSize		= 10000				// maximum number of cached entries.
+)
+
+var (
+	errProbeUnavailable	= errors.New("ffprobe is not available")
+	errNotPlayable		= errors.New("no audio or video streams found")
+)
+
+var (
+	ffprobePath setting[string]		// path to the ffprobe executable, as configured; empty disables probing.
+	ffprobeCommand setting[string]	// the executable actually found there; empty if none.
+)
+
+// MediaInfo is what we learn about a file by probing it.
+type MediaInfo struct {
+	Container string		`json:"container" xml:"container"`						// as reported by ffprobe, e.g. "mov,mp4,m4a,3gp,3g2,mj2".
+	Duration float64		`json:"duration" xml:"duration"`						// in seconds.
+	Bitrate int64			`json:"bitrate" xml:"bitrate"`							// overall bitrate, in bit/s.
+	VideoCodec string		`json:"videoCodec,omitempty" xml:"videoCodec,omitempty"`
+	Width int				`json:"width,omitempty" xml:"width,omitempty"`
+	Height int				`json:"height,omitempty" xml:"height,omitempty"`
+	AudioCodec string		`json:"audioCodec,omitempty" xml:"audioCodec,omitempty"`
+	SampleRate int			`json:"sampleRate,omitempty" xml:"sampleRate,omitempty"`	// in Hz.
+	Channels int			`json:"channels,omitempty" xml:"channels,omitempty"`
+}
+
+// Playable checks if there is anything that can be streamed.
+func (m MediaInfo) Playable() error {
+	if m.VideoCodec == "" && m.AudioCodec == "" {
+		return errNotPlayable
+	}
+	return nil
+}
+
+// Length returns the duration as a time.Duration.
+func (m MediaInfo) Length() time.Duration {
+	return time.Duration(m.Duration * float64(time.Second))
+}
+
+// Codecs returns a short description of the codecs, e.g. "h264 1280x720 / aac 44100 Hz".
+func (m MediaInfo) Codecs() string {
+	var parts []string
+	if m.VideoCodec != "" {
+		video := m.VideoCodec
+		if m.Width > 0 && m.Height > 0 {
+			video += fmt.Sprintf(" %dx%d", m.Width, m.Height)
+		}
+		parts = append(parts, video)
+	}
+	if m.AudioCodec != "" {
+		audio := m.AudioCodec
+		if m.SampleRate > 0 {
+			audio += fmt.Sprintf(" %d Hz", m.SampleRate)
+		}
+		parts = append(parts, audio)
+	}
+	return strings.Join(parts, " / ")
+}
+
+// ffprobeOutput is the subset of `ffprobe -print_format json` that we care about.
+type ffprobeOutput struct {
+	Format struct {
+		FormatName string	`json:"format_name"`
+		Duration string		`json:"duration"`
+		BitRate string		`json:"bit_rate"`
+	}	`json:"format"`
+	Streams []struct {
+		CodecType string	`json:"codec_type"`
+		CodecName string	`json:"codec_name"`
+		Width int			`json:"width"`
+		Height int			`json:"height"`
+		SampleRate string	`json:"sample_rate"`
+		Channels int		`json:"channels"`
+		Disposition struct {
+			AttachedPic int	`json:"attached_pic"`
+		}	`json:"disposition"`
+	}	`json:"streams"`
+}
+
+// probeCacheEntry is valid as long as the file keeps the same size and modification time.
+type probeCacheEntry struct {
+	size int64
+	modTime time.Time
+	info MediaInfo
+	err error		// files that can't be probed are cached, too.
+}
+
+var probeCache = struct {
+	sync.RWMutex
+	entries map[string]probeCacheEntry
+}{entries: make(map[string]probeCacheEntry)}
+
+// configureProbe checks if ffprobe can be found; if not, probing is disabled.
+func configureProbe() {
+	ffprobeCommand.Set("")
+	configured := ffprobePath.Get()
+	if configured == "" {
+		logme.Warnln("no ffprobe configured; files will not be checked before streaming")
+		return
+	}
+	path, err := exec.LookPath(configured)
+	if err != nil {
+		logme.Warnf("ffprobe not found at %q (%s); files will not be checked before streaming\n", configured, err)
+		return
+	}
+	ffprobeCommand.Set(path)
+	logme.Infof("using ffprobe at %q\n", path)
+}
+
+// probeMedia returns information about a media file, running ffprobe only if the file
+// was never probed before, or has changed since. Only what ffprobe found out is cached, be
+// it good or bad (including files it could not make sense of); failures to run it are not.
+// Unplayable files return errNotPlayable (wrapped).
+func probeMedia(path string) (MediaInfo, error) {
+	if ffprobeCommand.Get() == "" {
+		return MediaInfo{}, errProbeUnavailable
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return MediaInfo{}, err
+	}
+
+	probeCache.RLock()
+	entry, ok := probeCache.entries[path]
+	probeCache.RUnlock()
+	if ok && entry.size == fi.Size() && entry.modTime.Equal(fi.ModTime()) {
+		return entry.info, entry.err
+	}
+
+	info, err := runProbe(path)
+	if err != nil && !errors.Is(err, errNotPlayable) {
+		// ffprobe could not run, timed out or was killed, or its output made no sense; none of
+		// that says anything about the file, so it's not cached, and will be tried again.
+		return MediaInfo{}, fmt.Errorf("%q could not be probed: %w", path, err)
+	}
+	if err == nil {
+		err = info.Playable()
+	}
+	if err != nil {
+		err = fmt.Errorf("%q cannot be played: %w", path, err)
+	}
+	probeCache.Lock()
+	if len(probeCache.entries) >= probeCacheSize {
+		// crude, but simple: start over.
+		probeCache.entries = make(map[string]probeCacheEntry)
+	}
+	probeCache.entries[path] = probeCacheEntry{size: fi.Size(), modTime: fi.ModTime(), info: info, err: err}
+	probeCache.Unlock()
+	return info, err
+}
+
+// runProbe actually launches ffprobe and parses its output.
+// If ffprobe ran to the end, but complained about the file (e.g. "Invalid data found when
+// processing input"), the error wraps errNotPlayable.
+func runProbe(path string) (MediaInfo, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), probeTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, ffprobeCommand.Get(), "-v", "error", "-print_format", "json",
+		"-show_format", "-show_streams", "--", path)
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		msg := strings.TrimSpace(stderr.String())
+		var exitErr *exec.ExitError
+		if ctx.Err() == nil && errors.As(err, &exitErr) && exitErr.Exited() && msg != "" {
+			return MediaInfo{}, fmt.Errorf("%w: ffprobe says %s", errNotPlayable, msg)
+		}
+		if msg != "" {
+			return MediaInfo{}, fmt.Errorf("ffprobe: %w (%s)", err, msg)
+		}
+		return MediaInfo{}, fmt.Errorf("ffprobe: %w", err)
+	}
+
+	var probe ffprobeOutput
+	if err = json.Unmarshal(out, &probe); err != nil {
+		return MediaInfo{}, fmt.Errorf("ffprobe: invalid output: %w", err)
+	}
+	info := MediaInfo{Container: probe.Format.FormatName}
+	info.Duration, _ = strconv.ParseFloat(probe.Format.Duration, 64)
+	info.Bitrate, _ = strconv.ParseInt(probe.Format.BitRate, 10, 64)
+	// only the first audio and video streams matter; cover art shows up as a video stream, so skip it.
+	for _, stream := range probe.Streams {
+		switch stream.CodecType {
+			case "video":
+				if info.VideoCodec == "" && stream.Disposition.AttachedPic == 0 {
+					info.VideoCodec, info.Width, info.Height = stream.CodecName, stream.Width, stream.Height
+				}
+			case "audio":
+				if info.AudioCodec == "" {
+					info.AudioCodec, info.Channels = stream.CodecName, stream.Channels
+					info.SampleRate, _ = strconv.Atoi(stream.SampleRate)
+				}
+		}
+	}
+	return info, nil
+}
@@ -0,0 +1,162 @@
+// Transcoding profiles for ffmpeg.
+// Profiles are named sets of codecs, bitrates, scaling and keyframe interval, read from
+// a TOML file (see profiles.toml for an example); /api/play picks one by name.
+//
+// © 2023 by Gwyneth Llewelyn. All rights reserved.
+// Licensed under a MIT License (see https://gwyneth-llewelyn.mit-license.org/).
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/pelletier/go-toml/v2"
+)
+
+// Profile describes how ffmpeg should encode a stream.
+// Empty fields are simply not passed to ffmpeg.
+type Profile struct {
+	Description string		`toml:"description" json:"description" xml:"description"`
+	VideoCodec string		`toml:"video_codec" json:"videoCodec" xml:"videoCodec"`				// e.g. "copy", "libx264", or "none" to drop video.
+	AudioCodec string		`toml:"audio_codec" json:"audioCodec" xml:"audioCodec"`				// e.g. "copy", "aac", "libopus", or "none" to drop audio.
+	VideoBitrate string		`toml:"video_bitrate" json:"videoBitrate" xml:"videoBitrate"`		// e.g. "2500k".
+	AudioBitrate string		`toml:"audio_bitrate" json:"audioBitrate" xml:"audioBitrate"`		// e.g. "128k".
+	Scale string			`toml:"scale" json:"scale" xml:"scale"`								// width:height, as for ffmpeg's scale filter, e.g. "-2:720".
+	KeyframeInterval int	`toml:"keyframe_interval" json:"keyframeInterval" xml:"keyframeInterval"`	// in frames.
+	Preset string			`toml:"preset" json:"preset" xml:"preset"`							// encoder preset, e.g. "veryfast".
+	Tune string				`toml:"tune" json:"tune" xml:"tune"`								// encoder tuning, e.g. "zerolatency".
+	AudioChannels int		`toml:"audio_channels" json:"audioChannels" xml:"audioChannels"`
+	AudioRate int			`toml:"audio_rate" json:"audioRate" xml:"audioRate"`				// sample rate, in Hz.
+	ExtraArgs []string		`toml:"extra_args" json:"extraArgs" xml:"extraArgs>arg"`				// anything else, passed verbatim.
+}
+
+// profileConfig is the layout of the profiles file.
+type profileConfig struct {
+	Default string				`toml:"default"`
+	Profiles map[string]Profile	`toml:"profile"`
+}
+
+// Name of the profile used when none is given, and when no profiles file is found.
+const builtinProfileName = "copy"
+
+// builtinProfile just copies the streams, which is what StreamDude always did.
+var builtinProfile = Profile{
+	Description:	"copy audio and video streams as they are",
+	VideoCodec:		"copy",
+	AudioCodec:		"copy",
+	Tune:			"zerolatency",
+}
+
+var (
+	profilesPath setting[string]			// path to the profiles file, as set on the command line.
+	profilesMu sync.RWMutex					// profiles may be reloaded while running (see config.go).
+	profiles = map[string]Profile{builtinProfileName: builtinProfile}
+	defaultProfile = builtinProfileName
+)
+
+// loadProfiles reads the profiles file. If it doesn't exist, only the built-in
+// `copy` profile will be available.
+func loadProfiles(path string) error {
+	buf, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		logme.Infof("no profiles file found at %q; only the %q profile is available\n", path, builtinProfileName)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var config profileConfig
+	if err = toml.Unmarshal(buf, &config); err != nil {
+		return fmt.Errorf("invalid profiles file %q: %w", path, err)
+	}
+	if len(config.Profiles) == 0 {
+		return fmt.Errorf("no profiles defined in %q", path)
+	}
+	if config.Default == "" {
+		config.Default = builtinProfileName
+	}
+	if _, ok := config.Profiles[config.Default]; !ok {
+		return fmt.Errorf("default profile %q is not defined in %q", config.Default, path)
+	}
+	profilesMu.Lock()
+	profiles, defaultProfile = config.Profiles, config.Default
+	profilesMu.Unlock()
+	logme.Infof("profiles loaded from %q: %s (default: %q)\n", path, strings.Join(profileNames(), ", "), defaultProfile)
+	return nil
+}
+
+// profileNames returns the names of all configured profiles, sorted.
+func profileNames() []string {
+	profilesMu.RLock()
+	defer profilesMu.RUnlock()
+	names := make([]string, 0, len(profiles))
+	for name := range profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// lookupProfile returns the named profile, or the default one if `name` is empty.
+func lookupProfile(name string) (Profile, error) {
+	profilesMu.RLock()
+	if name == "" {
+		name = defaultProfile
+	}
+	profile, ok := profiles[name]
+	profilesMu.RUnlock()
+	if !ok {
+		return Profile{}, fmt.Errorf("unknown profile %q; available profiles are: %s", name, strings.Join(profileNames(), ", "))
+	}
+	return profile, nil
+}
+
+// args returns the ffmpeg output options for this profile.
+func (p Profile) args() []string {
+	var args []string
+	switch p.VideoCodec {
+		case "":
+		case "none":
+			args = append(args, "-vn")
+		default:
+			args = append(args, "-vcodec", p.VideoCodec)
+	}
+	switch p.AudioCodec {
+		case "":
+		case "none":
+			args = append(args, "-an")
+		default:
+			args = append(args, "-acodec", p.AudioCodec)
+	}
+	if p.VideoBitrate != "" {
+		args = append(args, "-b:v", p.VideoBitrate)
+	}
+	if p.AudioBitrate != "" {
+		args = append(args, "-b:a", p.AudioBitrate)
+	}
+	if p.Scale != "" {
+		args = append(args, "-vf", "scale=" + p.Scale)
+	}
+	if p.KeyframeInterval > 0 {
+		args = append(args, "-g", strconv.Itoa(p.KeyframeInterval))
+	}
+	if p.Preset != "" {
+		args = append(args, "-preset", p.Preset)
+	}
+	if p.Tune != "" {
+		args = append(args, "-tune", p.Tune)
+	}
+	if p.AudioChannels > 0 {
+		args = append(args, "-ac", strconv.Itoa(p.AudioChannels))
+	}
+	if p.AudioRate > 0 {
+		args = append(args, "-ar", strconv.Itoa(p.AudioRate))
+	}
+	return append(args, p.ExtraArgs...)
+}
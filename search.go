@@ -0,0 +1,200 @@
+// Search over the media library index.
+// Every term on the query must match (as a case-insensitive substring) either the path
+// of the file, relative to the media directory, or one of its tags; results may also be
+// filtered by extension, duration, album and directory, and are paginated.
+//
+// © 2023 by Gwyneth Llewelyn. All rights reserved.
+// Licensed under a MIT License (see https://gwyneth-llewelyn.mit-license.org/).
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+)
+
+// Results per page, if not specified; at most 500 are allowed.
+const searchDefaultLimit = 50
+
+// searchRequest is what /api/library/search accepts, on the query string.
+type searchRequest struct {
+	Token string			`form:"token"`
+	Query string			`form:"q"`														// space-separated terms.
+	Extensions string		`form:"ext"`													// comma-separated, e.g. "mp3,m4a".
+	MinDuration float64		`form:"minDuration" binding:"omitempty,min=0"`					// in seconds.
+	MaxDuration float64		`form:"maxDuration" binding:"omitempty,min=0"`					// in seconds.
+	Album string			`form:"album"`													// case-insensitive, exact.
+	Dir string				`form:"dir"`													// relative to the media directory; includes subdirectories.
+	Offset int				`form:"offset" binding:"omitempty,min=0"`
+	Limit int				`form:"limit" binding:"omitempty,min=1,max=500"`
+}
+
+// SearchResults is a page of search results.
+type SearchResults struct {
+	Total int				`json:"total" xml:"total"`		// number of matches, on all pages.
+	Offset int				`json:"offset" xml:"offset"`
+	Limit int				`json:"limit" xml:"limit"`
+	Results []PlayListEntry	`json:"results" xml:"results>result"`
+}
+
+// librarySearch holds a parsed search request.
+type librarySearch struct {
+	terms []string
+	extensions map[string]bool		// lowercase, with the leading dot.
+	minDuration, maxDuration float64
+	album string
+	dir string						// absolute.
+	root string						// absolute path to the media directory.
+}
+
+// newLibrarySearch validates and parses a search request.
+func newLibrarySearch(req searchRequest) (*librarySearch, error) {
+	s := &librarySearch{
+		terms:			strings.Fields(strings.ToLower(req.Query)),
+		minDuration:	req.MinDuration,
+		maxDuration:	req.MaxDuration,
+		album:			strings.ToLower(strings.TrimSpace(req.Album)),
+		root:			absPath(mediaDirectory.Get()),
+	}
+	if s.maxDuration > 0 && s.maxDuration < s.minDuration {
+		return nil, fmt.Errorf("maxDuration (%v) is lower than minDuration (%v)", s.maxDuration, s.minDuration)
+	}
+	for _, ext := range strings.Split(req.Extensions, ",") {
+		if ext = strings.ToLower(strings.TrimSpace(ext)); ext != "" {
+			if s.extensions == nil {
+				s.extensions = make(map[string]bool)
+			}
+			s.extensions["." + strings.TrimPrefix(ext, ".")] = true
+		}
+	}
+	if req.Dir != "" {
+		dir := filepath.FromSlash(req.Dir)
+		if !filepath.IsAbs(dir) {
+			dir = filepath.Join(mediaDirectory.Get(), dir)
+		}
+		s.dir = absPath(dir)
+		if s.dir != s.root && !insideDirectory(s.root, s.dir) {
+			return nil, fmt.Errorf("%q is outside the media directory", req.Dir)
+		}
+	}
+	return s, nil
+}
+
+// matches checks an index entry against all filters and terms.
+func (s *librarySearch) matches(e LibraryEntry) bool {
+	if !insideDirectory(s.root, e.Path) {
+		return false
+	}
+	if s.extensions != nil && !s.extensions[strings.ToLower(filepath.Ext(e.Path))] {
+		return false
+	}
+	var seconds float64
+	if e.Media != nil {
+		seconds = e.Media.Duration
+	}
+	if s.minDuration > 0 && seconds < s.minDuration {
+		return false
+	}
+	if s.maxDuration > 0 && (seconds == 0 || seconds > s.maxDuration) {
+		return false
+	}
+	if s.album != "" && (e.Tags == nil || strings.ToLower(e.Tags.Album) != s.album) {
+		return false
+	}
+	if s.dir != "" && !insideDirectory(s.dir, e.Path) {
+		return false
+	}
+	if len(s.terms) == 0 {
+		return true
+	}
+	text := searchText(e, s.root)
+	for _, term := range s.terms {
+		if !strings.Contains(text, term) {
+			return false
+		}
+	}
+	return true
+}
+
+// searchText is everything a query is matched against, in lowercase: the path, relative
+// to `root` (so that the media directory itself doesn't match everything), and the tags.
+func searchText(e LibraryEntry, root string) string {
+	parts := []string{strings.TrimPrefix(filepath.ToSlash(e.Path), filepath.ToSlash(root) + "/")}
+	if tags := e.Tags; tags != nil {
+		parts = append(parts, tags.Title, tags.Artist, tags.Album, tags.AlbumArtist, tags.Genre)
+		if tags.Year > 0 {
+			parts = append(parts, strconv.Itoa(tags.Year))
+		}
+	}
+	return strings.ToLower(strings.Join(parts, "\n"))
+}
+
+// Search returns a page of the items in the library that match, sorted by album and track.
+// Entries are filtered first, so that only the matches are turned into items and sorted.
+func (l *Library) Search(s *librarySearch, offset, limit int) SearchResults {
+	var matches []PlayListItem
+	l.mu.RLock()
+	for _, e := range l.entries {
+		if s.matches(e) {
+			matches = append(matches, e.Item())
+		}
+	}
+	l.mu.RUnlock()
+	sortByAlbum(matches)
+
+	results := SearchResults{Total: len(matches), Offset: offset, Limit: limit, Results: []PlayListEntry{}}
+	if offset < len(matches) {
+		for _, item := range matches[offset:min(offset + limit, len(matches))] {
+			results.Results = append(results.Results, item.Entry())
+		}
+	}
+	return results
+}
+
+/*
+ *  Router functions
+ */
+
+// apiSearchLibrary handles GET /api/library/search.
+func apiSearchLibrary(c *gin.Context) {
+	var req searchRequest
+	if err := c.ShouldBindQuery(&req); err != nil {
+		checkErrReply(c, http.StatusBadRequest, "search: invalid request", err)
+		return
+	}
+	if req.Token == "" {
+		req.Token = c.GetHeader("X-StreamDude-Token")
+	}
+	if checkToken(c, "play", req.Token) == nil {
+		return
+	}
+	search, err := newLibrarySearch(req)
+	if err != nil {
+		checkErrReply(c, http.StatusBadRequest, "search: invalid request", err)
+		return
+	}
+	if req.Limit == 0 {
+		req.Limit = searchDefaultLimit
+	}
+	results := library.Search(search, req.Offset, req.Limit)
+
+	switch getContentType(c) {
+		case binding.MIMEXML, "application/soap+xml", binding.MIMEXML2:
+			c.XML(http.StatusOK, gin.H{"status": "ok", "search": results})
+		case binding.MIMEPlain:
+			// one line for the totals, then one line per file, tab-separated, easy to parse in LSL.
+			var sb strings.Builder
+			fmt.Fprintf(&sb, "%d %d %d\n", results.Total, results.Offset, len(results.Results))
+			for _, entry := range results.Results {
+				fmt.Fprintf(&sb, "%s\t%s\t%.0f\n", entry.File, entry.Title, entry.Duration)
+			}
+			c.String(http.StatusOK, sb.String())
+		default:
+			c.JSON(http.StatusOK, gin.H{"status": "ok", "search": results})
+	}
+}
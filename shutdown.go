@@ -0,0 +1,120 @@
+// Graceful shutdown.
+// On SIGTERM, SIGINT or SIGHUP, new streaming requests are refused, running streams may be
+// allowed to finish (for a while), requests being handled are completed, and then all
+// players and ffmpeg processes are stopped before exiting, so that nothing is left behind.
+//
+// © 2023 by Gwyneth Llewelyn. All rights reserved.
+// Licensed under a MIT License (see https://gwyneth-llewelyn.mit-license.org/).
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/coreos/go-systemd/v22/daemon"
+	"github.com/gin-gonic/gin"
+)
+
+var (
+	drainTimeout setting[time.Duration]	// how long shutdown may wait for requests, and, separately, for streams.
+	drainStreams setting[bool]		// if set, running streams are allowed to finish before shutting down.
+	shuttingDown atomic.Bool		// set as soon as shutdown starts.
+)
+
+// refuseWhenShuttingDown is a middleware for the routes that start streaming.
+func refuseWhenShuttingDown(c *gin.Context) {
+	if shuttingDown.Load() {
+		c.Header("Connection", "close")
+		checkErrReply(c, http.StatusServiceUnavailable, "streaming", fmt.Errorf("StreamDude is shutting down"))
+		c.Abort()
+		return
+	}
+	c.Next()
+}
+
+// streamsRunning is true while any player or ffmpeg job is still streaming.
+func streamsRunning() bool {
+	for _, player := range players() {
+		if player.Status().Active {
+			return true
+		}
+	}
+	return len(jobs.Running()) > 0
+}
+
+// waitForStreams waits until nothing is streaming any longer, or until `ctx` is done.
+func waitForStreams(ctx context.Context) error {
+	ticker := time.NewTicker(250 * time.Millisecond)
+	defer ticker.Stop()
+	for streamsRunning() {
+		select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// shutdown stops the web server and everything that might still be streaming, and closes
+// the database. The server must not be used afterwards.
+// Streams (with drainStreams) and then requests get drainTimeout each, so that streams taking
+// all of it don't leave requests without any time; add the time needed to kill stubborn ffmpeg
+// processes, and that's how long it may take.
+func shutdown(server *http.Server) {
+	if !shuttingDown.CompareAndSwap(false, true) {
+		return	// already shutting down.
+	}
+	start := time.Now()
+	timeout := drainTimeout.Get()
+
+	if drainStreams.Get() && streamsRunning() {
+		logme.Infof("shutdown: waiting up to %v for running streams to finish\n", timeout)
+		daemon.SdNotify(false, "STATUS=waiting for running streams to finish")
+		streamsCtx, streamsCancel := context.WithTimeout(context.Background(), timeout)
+		if err := waitForStreams(streamsCtx); err != nil {
+			logme.Warnln("shutdown: streams still running, stopping them")
+		}
+		streamsCancel()
+	}
+
+	// No new connections from now on; requests being handled get their own deadline.
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		logme.Errorf("shutdown: web server did not stop cleanly: %s\n", err)
+	}
+
+	// Whatever is still streaming must stop now; ffmpeg is given jobStopGrace to do it.
+	for _, player := range players() {
+		if player.Status().Active {
+			if err := player.Stop(); err != nil {
+				logme.Errorf("shutdown: could not stop player: %s\n", err)
+			}
+		}
+	}
+	grace := jobStopGrace.Get()
+	stopCtx, stopCancel := context.WithTimeout(context.Background(), grace + time.Second)
+	defer stopCancel()
+	if err := jobs.StopAll(stopCtx, grace); err != nil {
+		logme.Errorf("shutdown: %s\n", err)
+	}
+	if err := waitForStreams(stopCtx); err != nil {
+		logme.Errorf("shutdown: players did not stop: %s\n", err)
+	}
+
+	removeHLSDirectory()
+
+	if mediaWatcher != nil {
+		if err := mediaWatcher.Close(); err != nil {
+			logme.Errorf("shutdown: could not stop watching the media directory: %s\n", err)
+		}
+	}
+	closeDatabase()
+
+	daemon.SdNotify(false, daemon.SdNotifyStopping + "\nSTATUS=shut down")
+	logme.Infof("shutdown finished in %v\n", time.Since(start).Round(time.Millisecond))
+}
@@ -6,6 +6,8 @@
 //
 // `LAL_MASTER_KEY` - because it's too dangerous to keep it in code and/or files
 // `STREAMER_URL` - another way to override the streamer URL; may be useful in scripts
+// `STREAMDUDE_ADMIN_KEY` - key for the administration API
+// `STREAMDUDE_<FLAG>` - any other setting, by its long flag name (see config.go)
 //
 // © 2023 by Gwyneth Llewelyn. All rights reserved.
 // Licensed under a MIT License (see https://gwyneth-llewelyn.mit-license.org/).
@@ -14,6 +16,7 @@ package main
 
 import (
 	//	"log"
+	"errors"
 	"fmt"
 	"html/template"
 	"net/http"
@@ -21,7 +24,9 @@ import (
 	"os/signal"
 	"path"
 	"path/filepath"
+	"strings"
 	"syscall"
+	"time"
 
 	"github.com/coreos/go-systemd/v22/daemon"
 	"github.com/gin-contrib/static"
@@ -38,7 +43,7 @@ import (
 
 var (
 	help bool					// if set, show usage
-	ffmpegPath string			// path to ffmpeg executable
+	ffmpegPath setting[string]	// path to ffmpeg executable
 	ginMode *string				// ginMode is `debug` for development, `release` for production.
 	host string					// this host — where StreamDude is running.
 	serverPort string			// port where StreamDude server is listening
@@ -48,10 +53,11 @@ var (
 	templatePath string			// where templates are held
 	pathToStaticFiles string	// where static assets are stored
 	workingDirectory string		// workingDirectory is the result of os.Getwd() or "." if that fails.
-	mediaDirectory string		// where media can be found on this server.
+	mediaDirectory setting[string]	// where media can be found on this server.
 	urlPathPrefix string		// URL path prefix
-	lslSignaturePIN string		// what we send from LSL
-	debug bool					// set to debug level
+	lslSignaturePIN setting[string]	// what we send from LSL
+	databasePath string			// where the embedded database is stored
+	debug setting[bool]			// set to debug level
 	activeSystemd bool	= true	// if set, systemd is available (checked on start)
 
 	// use a single instance of Validate, it caches struct info
@@ -60,9 +66,9 @@ var (
 	// Global logger using logrus.
 	logme = logrus.New()
 
-	// Stuff for the lal streaming server
-	streamerURL string		// RTSP streaming URL for lal
-	lalMasterKey string		// too dangerous to show, put into LAL_MASTER_KEY environment
+	// Stuff for the lal streaming server (other backends are on streamers.go)
+	streamerURL setting[string]	// RTSP streaming URL for lal
+	lalMasterKey setting[string]	// too dangerous to show, put into LAL_MASTER_KEY environment
 )
 
 /*
@@ -102,21 +108,62 @@ func main() {
 	}
 
 	// Extract things from command line
+	// Most flags may also be set on the configuration file and the environment (see config.go);
+	// `true` marks those that can be changed while running.
 	flag.BoolVarP(&help,			'h', "help",			false, 			"show command usage")
-	flag.StringVarP(&ffmpegPath,	'm', "ffmpeg",			"/usr/local/bin/ffmpeg", "path to ffmpeg executable")
-	flag.StringVarP(&host,			'j', "host",			"localhost", 	"server host where we're running")
-	flag.StringVarP(&serverPort,	'p', "port", 			":3554", 		"port where StreamDude server is listening")
-	flag.StringVarP(&frontEnd,		'f', "frontend", 		"nginx", 		"type of frontend/reverse proxy")
-	flag.StringVarP(&externalPort,	'P', "externalport",	":80",			"external port if using a reverse proxy")
-	flag.StringVarP(&externalHost,	'x', "externalhost",	hostname,		"external hostname if using a reverse proxy")
-	flag.StringVarP(&templatePath,	't', "templatepath",	"./templates",	"where the Gin HTML templates are held")
-	flag.StringVarP(&pathToStaticFiles, 's', "staticpath",	".",			"where static assets are stored")
-	flag.StringVarP(&mediaDirectory, 'g', "mediapath",		"./media",		"relative or absolute path where media files can be found for playlist streaming")
-	flag.StringVarP(&urlPathPrefix,	'u', "urlprefix",		"/",			"URL path prefix (with trailing slash)")
-	flag.StringVarP(&lslSignaturePIN, 'l',	"lslpin",		"0000",			"LSL signature PIN")
-	flag.BoolVarP(&debug,			'd', "debug",			false, 			"set debug level (omit for normal logs)")
-	flag.StringVarP(&streamerURL,	'r', "streamer",		"rtsp://127.0.0.1:554/",	"streamer URL")
-	flag.StringVarP(&lalMasterKey,	'k', "masterkey",		"",				"lal server master key")
+	flag.StringVarP(&configPath,	'c', "config",			"./streamdude.toml", "path to the configuration file")
+	stringOption(&ffmpegPath,		'm', "ffmpeg",			"/usr/local/bin/ffmpeg", true,	"path to ffmpeg executable")
+	stringOption(&ffprobePath,		'M', "ffprobe",			"/usr/local/bin/ffprobe", true,	"path to ffprobe executable (empty disables probing)")
+	stringOption(&host,				'j', "host",			"localhost", 	false,	"server host where we're running")
+	stringOption(&serverPort,		'p', "port", 			":3554", 		false,	"port where StreamDude server is listening")
+	stringOption(&frontEnd,			'f', "frontend", 		"nginx", 		false,	"type of frontend/reverse proxy")
+	stringOption(&externalPort,		'P', "externalport",	":80",			false,	"external port if using a reverse proxy")
+	stringOption(&externalHost,		'x', "externalhost",	hostname,		false,	"external hostname if using a reverse proxy")
+	stringOption(&templatePath,		't', "templatepath",	"./templates",	false,	"where the Gin HTML templates are held")
+	stringOption(&pathToStaticFiles, 's', "staticpath",		".",			false,	"where static assets are stored")
+	stringOption(&mediaDirectory,	'g', "mediapath",		"./media",		true,	"relative or absolute path where media files can be found for playlist streaming")
+	stringOption(&mediaRootsList,	'R', "mediaroots",		"",				true,	"comma-separated list of directories from where /api/play may stream files (default: the media path)")
+	stringOption(&audioExtensionsList, 0, "audioext",		defaultAudioExtensions,	true,	"comma-separated list of audio file extensions")
+	stringOption(&videoExtensionsList, 0, "videoext",		defaultVideoExtensions,	true,	"comma-separated list of video file extensions")
+	stringOption(&coverExtensionsList, 0, "coverext",		defaultCoverExtensions,	true,	"comma-separated list of image file extensions for album covers")
+	stringOption(&coverNamesList,	0, "covernames",		defaultCoverNames,		true,	"comma-separated list of album cover file name patterns, by order of priority")
+	stringOption(&thumbnailDirectory, 'H', "thumbnails",	"./thumbnails",	true,	"where video thumbnails are kept (empty disables them)")
+	stringOption(&profilesPath,		'F', "profiles",		"./profiles.toml", true,	"path to the ffmpeg transcoding profiles file")
+	stringOption(&urlPathPrefix,	'u', "urlprefix",		"/",			false,	"URL path prefix (with trailing slash)")
+	stringOption(&lslSignaturePIN,	'l', "lslpin",			"0000",			true,	"LSL signature PIN")
+	boolOption(&debug,				'd', "debug",			false, 			true,	"set debug level (omit for normal logs)")
+	stringOption(&streamerURL,		'r', "streamer",		"rtsp://127.0.0.1:554/", true,	"streamer URL")
+	stringOption(&lalMasterKey,		'k', "masterkey",		"",				true,	"lal server master key")
+	stringOption(&streamerBackend,	'B', "backend",			"lal",			true,	"default streaming-server backend (" + strings.Join(streamerNames, ", ") + ")")
+	stringOption(&mediaMTXURL,		0, "mediamtxurl",		"",				true,	"MediaMTX publishing URL (rtsp://, rtmp:// or srt://; empty disables it)")
+	stringOption(&mediaMTXUser,		0, "mediamtxuser",		"",				true,	"MediaMTX publishing user")
+	stringOption(&mediaMTXPassword,	0, "mediamtxpass",		"",				true,	"MediaMTX publishing password")
+	stringOption(&mediaMTXAPI,		0, "mediamtxapi",		"",				true,	"MediaMTX control API URL, to add paths before publishing (empty to skip)")
+	stringOption(&rtmpURL,			0, "rtmpurl",			"",				true,	"RTMP application URL, e.g. rtmp://127.0.0.1/live (empty disables it)")
+	stringOption(&rtmpStreamKey,	0, "streamkey",			"",				true,	"RTMP stream key (empty gives each file its own stream)")
+	stringOption(&srtURL,			0, "srturl",			"",				true,	"SRT listener URL, e.g. srt://127.0.0.1:8890 (empty disables it)")
+	stringOption(&srtPassphrase,	0, "srtpassphrase",		"",				true,	"SRT encryption passphrase")
+	stringOption(&icecastURL,		0, "icecasturl",		"",				true,	"Icecast mount URL, e.g. http://127.0.0.1:8000/radio.mp3 (empty disables it)")
+	stringOption(&icecastUser,		0, "icecastuser",		"source",		true,	"Icecast source user")
+	stringOption(&icecastPassword,	0, "icecastpass",		"",				true,	"Icecast source password")
+	stringOption(&icecastMethod,	0, "icecastmethod",		"PUT",			true,	"Icecast source method: PUT (Icecast 2.4 and later) or SOURCE")
+	stringOption(&icecastFormat,	0, "icecastformat",		"mp3",			true,	"Icecast stream format: mp3, aac or ogg")
+	stringOption(&icecastBitrate,	0, "icecastbitrate",	"128k",			true,	"Icecast stream bitrate")
+	stringOption(&icecastName,		0, "icecastname",		"StreamDude",	true,	"Icecast stream name")
+	stringOption(&hlsDirectory,		0, "hlsdir",			"",				false,	"where HLS output is written (empty for a temporary directory)")
+	durationOption(&hlsSegment,		0, "hlssegment",		4 * time.Second, true,	"duration of each HLS segment")
+	durationOption(&hlsWindow,		0, "hlswindow",			24 * time.Second, true,	"how far back HLS playlists go; older segments are deleted")
+	boolOption(&gaplessMode,		0, "gapless",			false,			true,	"stream audio playlists as one continuous stream, via ffmpeg, instead of VLC (always, on builds without it)")
+	durationOption(&crossfade,		0, "crossfade",			0,				true,	"how long to crossfade between tracks on gapless streams (0 for none)")
+	durationOption(&trackGap,		0, "trackgap",			0,				true,	"silence between tracks on gapless streams, when not crossfading")
+	stringOption(&databasePath,		'b', "database",		"./streamdude.db", false,	"path to the embedded database (tokens, etc.)")
+	stringOption(&adminKey,			'A', "adminkey",		"",				true,	"key for the administration API (empty disables it)")
+	durationOption(&jobStopGrace,	'G', "stopgrace",		5 * time.Second, true,	"how long to wait for ffmpeg to stop before killing it")
+	durationOption(&jobStallAfter,	'S', "stallafter",		10 * time.Second, true,	"warn when ffmpeg makes no progress for this long (0 disables warnings)")
+	durationOption(&watchDebounce,	'W', "watchdelay",		2 * time.Second, true,	"how long the media directory must be quiet before changes are indexed (0 disables watching)")
+	durationOption(&tokenTTL,		'T', "tokenttl",		24 * time.Hour,	true,	"how long authentication tokens remain valid (0 means forever)")
+	durationOption(&drainTimeout,	'D', "draintimeout",	10 * time.Second, true,	"how long to wait for requests (and, before that, for streams, see --drainstreams) when shutting down")
+	boolOption(&drainStreams,		0, "drainstreams",		false,			true,	"let running streams finish (within the drain timeout) when shutting down")
 
 	flag.Parse()
 
@@ -125,8 +172,17 @@ func main() {
 		os.Exit(0)
 	}
 
+	// Anything not set on the command line comes from the environment or the configuration file.
+	if err := loadConfig(configPath); err != nil {
+		fmt.Println("[ERROR]", err)
+		os.Exit(1)
+	}
+
 	// setup a single instance of the validator service.
 	validate = validator.New()
+
+	// the playlist player is long-lived, so that it can be remotely controlled.
+	mediaPlayer = newPlaylistPlayer()
 	/**
 	 * Starting backend web server using Gin Gonic.
 	 */
@@ -138,8 +194,10 @@ func main() {
 	router.SetFuncMap(template.FuncMap{
 		"bitTest": bitTest,
 		"formatAsDate": formatAsDate,
+		"formatDuration": formatDuration,
 		"pathEscape": pathEscape,
 		"baseName": baseName,
+		"browseURL": browseURL,
 	})
 
 	// Configure logrus.
@@ -151,7 +209,7 @@ func main() {
 	logme.Formatter.(*logrus.TextFormatter).DisableTimestamp = false	// keep timestamp
 
 	// set debug level, depending on the argument value
-	if (debug) {
+	if (debug.Get()) {
 		logme.SetLevel(logrus.DebugLevel)
 	}
 
@@ -182,25 +240,26 @@ func main() {
 	logme.Debugf("Logging debug level set to %q\n", logme.GetLevel().String())
 
 
-	// Override lal master key from environment.
-	if temp := os.Getenv("LAL_MASTER_KEY"); temp != "" {
-		lalMasterKey = temp
-	}
-	if lalMasterKey == "" {
+	// Note: the lal master key, the admin key and the streamer may also come from the
+	// environment (see config.go).
+	if lalMasterKey.Get() == "" && streamerBackend.Get() == "lal" {
 		logme.Warningln("lal master key not found or empty; streaming will probably not work.")
 	} else {
-		logme.Debugf("lal key (obfuscated): %q\n", obfuscate(lalMasterKey))
+		logme.Debugf("lal key (obfuscated): %q\n", obfuscate(lalMasterKey.Get()))
 	}
 
-	// Override streamer, if env exists.
-	if temp := os.Getenv("STREAMER_URL"); temp != "" {
-		streamerURL = temp
-	}
 	// Validate that the streamer has a valid URL (either from command-line or env var).
-	if err := validate.Var(streamerURL, "required,url"); err != nil {
-		logme.Fatalf("invalid streamer URL: %q, aborting\n", streamerURL)
+	if err := validate.Var(streamerURL.Get(), "required,url"); err != nil {
+		logme.Fatalf("invalid streamer URL: %q, aborting\n", streamerURL.Get())
+	}
+	logme.Infof("remote streamer URL set to: %q\n", streamerURL.Get())
+	if err := configureHLS(); err != nil {
+		logme.Fatalf("%s, aborting\n", err)
 	}
-	logme.Infof("remote streamer URL set to: %q\n", streamerURL)
+	if err := validateStreamers(); err != nil {
+		logme.Fatalf("invalid streaming backend configuration: %s, aborting\n", err)
+	}
+	logme.Infof("default streaming backend: %q\n", streamerBackend.Get())
 
 	if err := validate.Var(externalHost, "hostname_rfc1123,omitempty"); err != nil {
 		logme.Errorf("invalid external host name: %q, reverting to empty string\n", externalHost)
@@ -209,14 +268,61 @@ func main() {
 	logme.Infof("external hostname set to: %q (empty is ok)\n", externalHost)
 
 	// Validate absolute path to media files. /tmp is perfectly acceptable and valid.
-	if err := validate.Var(mediaDirectory, "dir"); err == nil {
+	if err := validate.Var(mediaDirectory.Get(), "dir"); err == nil {
 		// no errors, so directory exists.
-		logme.Infof("valid media directory found at %q (default should be `.` which is ok)\n", mediaDirectory)
+		logme.Infof("valid media directory found at %q (default should be `.` which is ok)\n", mediaDirectory.Get())
 	} else {
 		// path is not even well-formed:
-		logme.Warnf("invalid directory path %q, error was: %v\n", mediaDirectory, err)
+		logme.Warnf("invalid directory path %q, error was: %v\n", mediaDirectory.Get(), err)
+	}
+	// Only files under these directories may be streamed via /api/play.
+	if err := configureMediaRoots(mediaRootsList.Get()); err != nil {
+		logme.Warnf("%s; /api/play will refuse all files\n", err)
+	}
+	// Which files are audio, video and album covers.
+	configureMediaTypes()
+	// ffprobe is used to check files before streaming them.
+	configureProbe()
+	// Transcoding profiles for /api/play; if they can't be loaded, fall back to copying streams.
+	if err := loadProfiles(profilesPath.Get()); err != nil {
+		logme.Errorf("%s; only the %q profile is available\n", err, builtinProfileName)
+	}
+
+	// Open the embedded database; if that fails, tokens will just be kept in memory.
+	if db, err = openDatabase(databasePath, tokenBucket, objectBucket, libraryBucket); err != nil {
+		logme.Errorf("%s; tokens will not persist across restarts\n", err)
+		tokenStore = newMemTokenStore()
+	} else {
+		logme.Infof("database opened at %q\n", databasePath)
+		tokenStore = newBoltTokenStore(db)
 	}
 
+	// Subcommands run and exit without launching the server.
+	if flag.NArg() > 0 {
+		switch flag.Arg(0) {
+			case "objects":
+				exitCode := objectsCommand(flag.Args()[1:])
+				closeDatabase()
+				removeHLSDirectory()
+				os.Exit(exitCode)
+			case "streamtest":
+				exitCode := streamtestCommand(flag.Args()[1:])
+				closeDatabase()
+				removeHLSDirectory()
+				os.Exit(exitCode)
+			default:
+				logme.Fatalf("unknown command %q\n", flag.Arg(0))
+		}
+	}
+
+	// Load the library index, and bring it up to date in the background.
+	library = NewLibrary(db)
+	if err := library.StartRescan(mediaDirectory.Get()); err != nil {
+		logme.Errorf("could not rescan the library: %s\n", err)
+	}
+	// ... and keep it up to date as files come and go.
+	startWatcher()
+
 	// TODO(gwyneth): validate path to assets and templates. (gwyneth 20230826)
 	// This is slightly more complex, as the relative path may be prefixed.
 
@@ -259,6 +365,7 @@ func main() {
 
 	// Ping handler (who knows, it might be useful in some contexts... such as Let's Encrypt certificates
 	router.Any(path.Join(urlPathPrefix, "ping"),			uiPing)
+	router.GET(path.Join(urlPathPrefix, "hls", ":stream", ":file"), serveHLS)
 
 	// Main website, as far as we can call it a "website".
 	router.GET(path.Join(urlPathPrefix, "home"), 			homepage)
@@ -270,10 +377,45 @@ func main() {
 	// Lower-leval API for calling things (mostly non-tty low-level calls)
 	apiRoutes := router.Group(path.Join(urlPathPrefix, "api"))
 	{		// base page for complex scripts.
-		apiRoutes.POST("/play",	apiStreamFile)
+		apiRoutes.POST("/play",	refuseWhenShuttingDown, apiStreamFile)
 		apiRoutes.POST("/auth",	apiSimpleAuthGenKey)
 		apiRoutes.POST("/delete", apiDeleteToken)
-		apiRoutes.POST("/stream", apiStreamPath)
+		apiRoutes.POST("/stream", refuseWhenShuttingDown, apiStreamPath)
+
+		// Server-side playlists.
+		apiRoutes.GET("/playlists",			apiListPlaylists)
+		apiRoutes.POST("/playlists",		apiCreatePlaylist)
+		apiRoutes.GET("/playlists/:id",		apiGetPlaylist)
+		apiRoutes.DELETE("/playlists/:id",	apiDeletePlaylist)
+		apiRoutes.GET("/playlists/:id/export",	apiExportPlaylist)
+		apiRoutes.POST("/playlists/import",	apiImportPlaylist)
+
+		// Remote control for the playlist player.
+		playerRoutes := apiRoutes.Group("/player")
+		{
+			playerRoutes.GET("",			apiPlayerStatus)
+			for _, action := range []string{"stop", "pause", "resume", "next", "previous", "seek", "volume"} {
+				playerRoutes.POST("/" + action, apiPlayerControl(action))
+			}
+		}
+
+		// Supervised ffmpeg jobs.
+		apiRoutes.GET("/jobs",				apiListJobs)
+		apiRoutes.GET("/jobs/:id",			apiGetJob)
+		apiRoutes.POST("/jobs/:id/stop",	apiStopJob)
+
+		// Media library index.
+		apiRoutes.GET("/library/rescan",	apiRescanStatus)
+		apiRoutes.POST("/library/rescan",	apiStartRescan)
+		apiRoutes.GET("/library/search",	apiSearchLibrary)
+
+		// Administration of the in-world object registry.
+		adminRoutes := apiRoutes.Group("/objects", requireAdmin)
+		{
+			adminRoutes.GET("",				apiListObjects)
+			adminRoutes.POST("",			apiAddObject)
+			adminRoutes.DELETE("/:key",		apiRemoveObject)
+		}
 	}
 
 	// Specific routes just for the user interface
@@ -290,6 +432,9 @@ func main() {
 			}))
 		})
 		uiRoutes.GET("/stream", uiStream)
+		uiRoutes.GET("/cover", uiCover)
+		uiRoutes.GET("/thumbnail", uiThumbnail)
+		uiRoutes.GET("/playlists/:id/export", uiExportPlaylist)
 	}
 
 	// Catch all other routes and send back an error
@@ -310,28 +455,42 @@ func main() {
 	// prepares a special (buffered) channel to look for termination signals.
 	sigs := make(chan os.Signal, 1)
 	// signal.Notify(sigs)	// Note: this should catch all catchable signals!
-	signal.Notify(sigs, syscall.SIGHUP, syscall.SIGUSR1, syscall.SIGUSR2, syscall.SIGCONT)
+	signal.Notify(sigs, syscall.SIGHUP, syscall.SIGTERM, syscall.SIGINT, syscall.SIGUSR1, syscall.SIGUSR2, syscall.SIGCONT)
+
+	// the web server is shut down by the signal handler, which then passes on the exit code.
+	server := &http.Server{
+		Addr:		host + serverPort,
+		Handler:	router,
+	}
+	shutdownExit := make(chan int, 1)
 
 	// goroutine which listens to signals
-	// Will handle re-configurations in the future.
-	// For now, it exists mostly to signal systemd
+	// Handles re-configurations, graceful shutdowns, and signals systemd
 	go func() {
 		for {
 			sig := <-sigs
 			switch sig {
 				case syscall.SIGUSR1:
-					daemon.SdNotify(false, daemon.SdNotifyReloading + "\nSTATUS=reloading request received, but config reload is not supported yet")
-					logme.Infoln("SIGUSR1 received, ignoring; we might reload config one day")
-					daemon.SdNotify(false, daemon.SdNotifyReady)
+					logme.Infof("SIGUSR1 received, reloading configuration from %q\n", configPath)
+					reloadConfig()
 				case syscall.SIGUSR2:
 					logme.Infoln("SIGUSR2 received, ignoring")
-				case syscall.SIGHUP:
-					// Note: we *might* interpret this to suspend the processing and/or reload config (gwyneth 202230804)
-					logme.Infoln("SIGHUP received (possibly from systemd): hanging up!")
-					// if we were called by systemd, then notify it that we're done.
-					// if not, just exit normally.
-					daemon.SdNotify(true, daemon.SdNotifyStopping)
-					os.Exit(129)
+				case syscall.SIGHUP, syscall.SIGTERM, syscall.SIGINT:
+					// Note: we *might* interpret SIGHUP to suspend the processing and/or reload config (gwyneth 202230804)
+					if shuttingDown.Load() {
+						logme.Infof("%s received, already shutting down\n", sig)
+						continue
+					}
+					logme.Infof("%s received (possibly from systemd): shutting down\n", sig)
+					// SIGHUP keeps its old exit code, so that scripts relying on it don't break.
+					exitCode := 0
+					if sig == syscall.SIGHUP {
+						exitCode = 129
+					}
+					go func() {
+						shutdown(server)
+						shutdownExit <- exitCode
+					}()
 				case syscall.SIGCONT:
 					logme.Infoln("SIGCONT received, ignoring")
 				default:
@@ -361,7 +520,12 @@ func main() {
 	 */
 
 	// this might require another layer to check for https
-	errGin := router.Run(host + serverPort)
+	logme.Infof("listening and serving HTTP on %s\n", server.Addr)
+	errGin := server.ListenAndServe()
+	if errors.Is(errGin, http.ErrServerClosed) {
+		// graceful shutdown, which already notified systemd; wait until it's finished.
+		os.Exit(<-shutdownExit)
+	}
 
 	// Notify systemd that we're peacefully stopping
 	b, err = daemon.SdNotify(true, daemon.SdNotifyStopping  + "\nEXIT_STATUS=126")
@@ -382,5 +546,6 @@ func main() {
 	} else {
 		logme.Errorln("Unexpected error, Gin terminated abruptly without error code")
 	}
+	closeDatabase()
 	os.Exit(126)
 }
\ No newline at end of file
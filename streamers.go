@@ -0,0 +1,447 @@
+// Streaming-server backends.
+// ffmpeg pushes each stream to a streaming server, and every kind of server wants it
+// somewhat differently: lal authenticates with a hash on the URL, MediaMTX with a user and
+// password (on the URL, or set up via its control API), RTMP servers with a stream key,
+// and SRT listeners with a stream ID and passphrase. The backend is chosen per deployment
+// (with --backend), or per request.
+//
+// © 2023 by Gwyneth Llewelyn. All rights reserved.
+// Licensed under a MIT License (see https://gwyneth-llewelyn.mit-license.org/).
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Streamer pushes streams to a particular kind of streaming server.
+type Streamer interface {
+	// Name is the name of the backend, as used on --backend and on requests.
+	Name() string
+	// Publish gets the server ready (if needed) to receive a stream for `filename`, and
+	// returns the URL that ffmpeg must push it to, as well as the ffmpeg output options
+	// for that URL (these go after the transcoding profile).
+	Publish(filename string) (target string, args []string, err error)
+	// Redact hides the secrets on a target URL, for logs and job listings.
+	Redact(target string) string
+}
+
+// pipeStreamer is implemented by backends that take the stream from ffmpeg's standard
+// output, rather than having ffmpeg push it somewhere. Progress reports are not available
+// for those. If they're also an io.Closer, they must be closed when done streaming.
+type pipeStreamer interface {
+	Streamer
+	io.Writer
+}
+
+var (
+	streamerBackend setting[string]	// default backend, see lookupStreamer.
+
+	mediaMTXURL setting[string]	// MediaMTX publishing URL (rtsp://, rtmp:// or srt://).
+	mediaMTXUser setting[string]	// MediaMTX publishing user; may be empty.
+	mediaMTXPassword setting[string]	// MediaMTX publishing password; may be empty.
+	mediaMTXAPI setting[string]	// MediaMTX control API URL; if set, paths are added there before publishing.
+
+	rtmpURL setting[string]		// RTMP application URL, e.g. rtmp://127.0.0.1/live.
+	rtmpStreamKey setting[string]	// RTMP stream key; if empty, each file gets its own stream.
+
+	srtURL setting[string]		// SRT listener URL, e.g. srt://127.0.0.1:8890.
+	srtPassphrase setting[string]	// SRT encryption passphrase (10 to 79 characters); may be empty.
+)
+
+var (
+	errUnknownStreamer = errors.New("unknown streaming backend")
+	errStreamerNotConfigured = errors.New("streaming backend not configured")
+)
+
+// jobStreamer is implemented by backends that need to know which job is streaming what
+// was last published (e.g. to clean up after it). `job` is nil if it could not start.
+type jobStreamer interface {
+	Streamer
+	Attach(job *Job)
+}
+
+// titleStreamer is implemented by backends that can tell listeners what's playing, while
+// a single ffmpeg streams several tracks (see gapless-player.go).
+type titleStreamer interface {
+	Streamer
+	SetTitle(title string) error
+}
+
+// Names of all backends, in the order they're listed on errors and on the help text.
+var streamerNames = []string{"lal", "mediamtx", "rtmp", "srt", "icecast", "hls"}
+
+// lookupStreamer returns the named backend, or the default one if `name` is empty.
+// Backends are built from the current settings, which may change while running.
+func lookupStreamer(name string) (Streamer, error) {
+	if name == "" {
+		name = streamerBackend.Get()
+	}
+	var (
+		streamer Streamer
+		base string
+	)
+	switch strings.ToLower(name) {
+		case "lal":
+			streamer, base = lalStreamer{base: streamerURL.Get(), masterKey: lalMasterKey.Get()}, streamerURL.Get()
+		case "mediamtx":
+			streamer, base = mediaMTXStreamer{base: mediaMTXURL.Get(), user: mediaMTXUser.Get(), password: mediaMTXPassword.Get(), api: mediaMTXAPI.Get()}, mediaMTXURL.Get()
+		case "rtmp":
+			streamer, base = rtmpStreamer{base: rtmpURL.Get(), key: rtmpStreamKey.Get()}, rtmpURL.Get()
+		case "srt":
+			streamer, base = srtStreamer{base: srtURL.Get(), passphrase: srtPassphrase.Get()}, srtURL.Get()
+		case "icecast":
+			streamer, base = &icecastStreamer{
+				base:		icecastURL.Get(),
+				user:		icecastUser.Get(),
+				password:	icecastPassword.Get(),
+				method:		strings.ToUpper(icecastMethod.Get()),
+				format:		strings.ToLower(icecastFormat.Get()),
+				bitrate:	icecastBitrate.Get(),
+				name:		icecastName.Get(),
+			}, icecastURL.Get()
+		case "hls":
+			streamer, base = newHLSStreamer(), hlsRoot
+		default:
+			return nil, fmt.Errorf("%w %q; available backends are: %s", errUnknownStreamer, name, strings.Join(streamerNames, ", "))
+	}
+	if base == "" {
+		return nil, fmt.Errorf("%w: no URL set for %q", errStreamerNotConfigured, streamer.Name())
+	}
+	return streamer, nil
+}
+
+// validateStreamers checks the URLs of all configured backends, and whether the default
+// backend is usable.
+func validateStreamers() error {
+	for _, name := range streamerNames {
+		streamer, err := lookupStreamer(name)
+		if errors.Is(err, errStreamerNotConfigured) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if _, _, err = streamer.Publish(""); err != nil {
+			return fmt.Errorf("invalid URL for %q: %w", name, err)
+		}
+	}
+	_, err := lookupStreamer("")
+	return err
+}
+
+// streamName turns a file name into something that all servers accept as the name of a
+// stream: the base name, without extension, with anything unusual replaced by underscores.
+func streamName(filename string) string {
+	name := strings.TrimSuffix(filepath.Base(filename), filepath.Ext(filename))
+	name = unsafeStreamChars.ReplaceAllString(name, "_")
+	if name == "" || name == "." {
+		return "stream"
+	}
+	return name
+}
+
+var unsafeStreamChars = regexp.MustCompile(`[^A-Za-z0-9_.~-]+`)
+
+// parseStreamURL parses a backend URL, checking its scheme.
+func parseStreamURL(rawURL string, schemes ...string) (*url.URL, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	for _, scheme := range schemes {
+		if strings.EqualFold(u.Scheme, scheme) {
+			if u.Host == "" {
+				return nil, fmt.Errorf("no host on %q", obfuscateURL(rawURL))
+			}
+			return u, nil
+		}
+	}
+	return nil, fmt.Errorf("unsupported scheme %q on %q (expected %s)", u.Scheme, obfuscateURL(rawURL), strings.Join(schemes, " or "))
+}
+
+// outputArgs are the ffmpeg output options for each kind of URL.
+func outputArgs(scheme string) []string {
+	switch strings.ToLower(scheme) {
+		case "rtmp", "rtmps":
+			return []string{"-f", "flv"}
+		case "srt":
+			return []string{"-f", "mpegts"}
+		default:	// rtsp, rtsps
+			return []string{"-f", "rtsp", "-muxdelay", "0.1", "-rtsp_transport", "tcp"}
+	}
+}
+
+/*
+ *  lal
+ */
+
+// lalStreamer pushes via RTSP to lal, which authenticates each stream with the MD5 hash of
+// its master key followed by the stream name.
+type lalStreamer struct {
+	base string
+	masterKey string
+}
+
+func (s lalStreamer) Name() string {
+	return "lal"
+}
+
+func (s lalStreamer) Publish(filename string) (string, []string, error) {
+	u, err := parseStreamURL(s.base, "rtsp", "rtsps")
+	if err != nil {
+		return "", nil, err
+	}
+	// lal streams are named after the file, extension and all, as they always were.
+	basename := filepath.Base(filename)
+	u = u.JoinPath(basename)
+	u.RawQuery = "lal_secret=" + getMD5Hash(s.masterKey + basename)
+	return u.String(), outputArgs(u.Scheme), nil
+}
+
+func (s lalStreamer) Redact(target string) string {
+	return obfuscateURL(target)
+}
+
+/*
+ *  MediaMTX
+ */
+
+var errMediaMTXAPI = errors.New("MediaMTX API")
+
+// mediaMTXStreamer publishes on MediaMTX, via RTSP, RTMP or SRT. The user and password go on
+// the URL (or on the stream ID, for SRT). If the control API is set, the path is added
+// there first, so that MediaMTX doesn't need to be configured in advance.
+type mediaMTXStreamer struct {
+	base string
+	user string
+	password string
+	api string
+}
+
+func (s mediaMTXStreamer) Name() string {
+	return "mediamtx"
+}
+
+func (s mediaMTXStreamer) Publish(filename string) (string, []string, error) {
+	u, err := parseStreamURL(s.base, "rtsp", "rtsps", "rtmp", "rtmps", "srt")
+	if err != nil {
+		return "", nil, err
+	}
+	path := strings.Trim(u.Path, "/")
+	if path == "" {
+		path = streamName(filename)
+	}
+	if strings.EqualFold(u.Scheme, "srt") {
+		// MediaMTX wants publish:path[:user:pass] on the stream ID, and nothing on the path.
+		streamID := "publish:" + path
+		if s.user != "" {
+			streamID += ":" + s.user + ":" + s.password
+		}
+		query := u.Query()
+		query.Set("streamid", streamID)
+		u.Path, u.RawQuery = "", query.Encode()
+	} else {
+		u.Path = "/" + path
+		if s.user != "" {
+			u.User = url.UserPassword(s.user, s.password)
+		}
+	}
+	if filename != "" && s.api != "" {
+		if err = s.addPath(path); err != nil {
+			return "", nil, err
+		}
+	}
+	return u.String(), outputArgs(u.Scheme), nil
+}
+
+func (s mediaMTXStreamer) Redact(target string) string {
+	return obfuscateURL(target)	// hides the password, and the stream ID (for SRT).
+}
+
+// addPath adds a path accepting publishers via the MediaMTX control API. Paths that
+// already exist are fine.
+func (s mediaMTXStreamer) addPath(path string) error {
+	endpoint, err := url.JoinPath(s.api, "v3/config/paths/add", path)
+	if err != nil {
+		return fmt.Errorf("%w: %w", errMediaMTXAPI, err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5 * time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, strings.NewReader(`{"source":"publisher"}`))
+	if err != nil {
+		return fmt.Errorf("%w: %w", errMediaMTXAPI, err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if s.user != "" {
+		req.SetBasicAuth(s.user, s.password)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("%w: %w", errMediaMTXAPI, err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	switch {
+		case resp.StatusCode < 300:
+			logme.Debugf("MediaMTX path %q added\n", path)
+		case resp.StatusCode == http.StatusBadRequest && bytes.Contains(body, []byte("already exists")):
+			logme.Debugf("MediaMTX path %q already exists\n", path)
+		default:
+			return fmt.Errorf("%w: could not add path %q: %s %s", errMediaMTXAPI, path, resp.Status, bytes.TrimSpace(body))
+	}
+	return nil
+}
+
+/*
+ *  RTMP
+ */
+
+// rtmpStreamer pushes to any RTMP server (nginx-rtmp, Owncast, etc.) with a stream key,
+// appended to the application URL. Without a key, each file gets its own stream.
+type rtmpStreamer struct {
+	base string
+	key string
+}
+
+func (s rtmpStreamer) Name() string {
+	return "rtmp"
+}
+
+func (s rtmpStreamer) Publish(filename string) (string, []string, error) {
+	u, err := parseStreamURL(s.base, "rtmp", "rtmps")
+	if err != nil {
+		return "", nil, err
+	}
+	key := s.key
+	if key == "" {
+		key = streamName(filename)
+	}
+	// the key is not a path, and must go verbatim (it may have query parameters).
+	return strings.TrimSuffix(u.String(), "/") + "/" + key, outputArgs(u.Scheme), nil
+}
+
+func (s rtmpStreamer) Redact(target string) string {
+	if s.key != "" {
+		target = strings.TrimSuffix(target, s.key) + "********"
+	}
+	return obfuscateURL(target)
+}
+
+/*
+ *  SRT
+ */
+
+// srtStreamer pushes to an SRT listener, naming the stream on the stream ID, as defined by
+// the SRT access control guidelines, unless the URL already sets one.
+type srtStreamer struct {
+	base string
+	passphrase string
+}
+
+func (s srtStreamer) Name() string {
+	return "srt"
+}
+
+func (s srtStreamer) Publish(filename string) (string, []string, error) {
+	u, err := parseStreamURL(s.base, "srt")
+	if err != nil {
+		return "", nil, err
+	}
+	query := u.Query()
+	if !query.Has("streamid") {
+		query.Set("streamid", "#!::r=" + streamName(filename) + ",m=publish")
+	}
+	if s.passphrase != "" {
+		if len(s.passphrase) < 10 || len(s.passphrase) > 79 {
+			return "", nil, fmt.Errorf("SRT passphrases must have between 10 and 79 characters")
+		}
+		query.Set("passphrase", s.passphrase)
+	}
+	if !query.Has("mode") {
+		query.Set("mode", "caller")
+	}
+	u.RawQuery = query.Encode()
+	return u.String(), outputArgs(u.Scheme), nil
+}
+
+func (s srtStreamer) Redact(target string) string {
+	return obfuscateURL(target)
+}
+
+/*
+ *  Testing
+ */
+
+// streamtestCommand pushes a test pattern (with a tone) to a backend for a few seconds,
+// to check it against the real server, or against a stand-in listener, such as:
+//
+//	ffmpeg -listen 1 -f flv -i rtmp://127.0.0.1:1935/live/test -f null -
+//	ffmpeg -f mpegts -i 'srt://127.0.0.1:8890?mode=listener' -f null -
+func streamtestCommand(args []string) int {
+	usage := func() int {
+		fmt.Fprintf(os.Stderr, "usage: %s [flags] streamtest [backend] [duration]\n" +
+			"backends: %s (default: %s); duration defaults to 5s\n", os.Args[0], strings.Join(streamerNames, ", "), streamerBackend.Get())
+		return 2
+	}
+	if len(args) > 2 {
+		return usage()
+	}
+	name, duration := "", 5 * time.Second
+	if len(args) > 0 {
+		name = args[0]
+	}
+	if len(args) > 1 {
+		var err error
+		if duration, err = time.ParseDuration(args[1]); err != nil || duration <= 0 {
+			return usage()
+		}
+	}
+	streamer, err := lookupStreamer(name)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	target, outArgs, err := streamer.Publish("streamdude-test")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "could not publish:", err)
+		return 1
+	}
+	ffArgs := []string{"-nostats", "-loglevel", "error", "-re",
+		"-f", "lavfi", "-i", "testsrc2=size=640x360:rate=25",
+		"-f", "lavfi", "-i", "sine=frequency=440:sample_rate=48000",
+		"-t", strconv.FormatFloat(duration.Seconds(), 'f', -1, 64),
+		"-c:v", "libx264", "-preset", "veryfast", "-tune", "zerolatency", "-pix_fmt", "yuv420p", "-g", "50",
+		"-c:a", "aac", "-b:a", "128k"}
+	ffArgs = append(ffArgs, outArgs...)
+	ffArgs = append(ffArgs, target)
+	fmt.Printf("streaming a test pattern to %s for %v...\n", streamer.Redact(target), duration)
+
+	var stderr bytes.Buffer
+	cmd := exec.Command(ffmpegPath.Get(), ffArgs...)
+	cmd.Stderr = &stderr
+	if pipe, ok := streamer.(pipeStreamer); ok {
+		cmd.Stdout = pipe
+	}
+	if closer, ok := streamer.(io.Closer); ok {
+		defer closer.Close()
+	}
+	if err = cmd.Run(); err != nil {
+		fmt.Fprintf(os.Stderr, "%s failed: %s\n%s", streamer.Name(), err, stderr.String())
+		return 1
+	}
+	fmt.Printf("%s: ok\n", streamer.Name())
+	return 0
+}
@@ -0,0 +1,190 @@
+// Metadata tags (ID3v2 for MP3, atoms for M4A/AAC) for playlist items.
+// Tags give us proper titles, artists, albums and track numbers, as well as any
+// embedded cover art, which is served by /ui/cover when there is no cover image on the album.
+//
+// © 2023 by Gwyneth Llewelyn. All rights reserved.
+// Licensed under a MIT License (see https://gwyneth-llewelyn.mit-license.org/).
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dhowden/tag"
+	"github.com/gin-gonic/gin"
+)
+
+// Maximum number of cached tags; see probeCacheSize.
+const tagCacheSize = 10000
+
+// Tags is the metadata we read from a media file.
+type Tags struct {
+	Title string		`json:"title,omitempty" xml:"title,omitempty"`
+	Artist string		`json:"artist,omitempty" xml:"artist,omitempty"`
+	Album string		`json:"album,omitempty" xml:"album,omitempty"`
+	AlbumArtist string	`json:"albumArtist,omitempty" xml:"albumArtist,omitempty"`
+	Track int			`json:"track,omitempty" xml:"track,omitempty"`
+	Tracks int			`json:"tracks,omitempty" xml:"tracks,omitempty"`	// total number of tracks on the album.
+	Disc int			`json:"disc,omitempty" xml:"disc,omitempty"`
+	Year int			`json:"year,omitempty" xml:"year,omitempty"`
+	Genre string		`json:"genre,omitempty" xml:"genre,omitempty"`
+	HasCover bool		`json:"hasCover" xml:"hasCover"`					// there is embedded cover art.
+}
+
+// tagCacheEntry is valid as long as the file keeps the same size and modification time.
+type tagCacheEntry struct {
+	size int64
+	modTime time.Time
+	tags *Tags		// nil if the file has no (readable) tags.
+}
+
+var tagCache = struct {
+	sync.RWMutex
+	entries map[string]tagCacheEntry
+}{entries: make(map[string]tagCacheEntry)}
+
+// readTags returns the tags of a media file, or nil if it has none.
+// Results are cached until the file changes.
+func readTags(path string) (*Tags, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	tagCache.RLock()
+	entry, ok := tagCache.entries[path]
+	tagCache.RUnlock()
+	if ok && entry.size == fi.Size() && entry.modTime.Equal(fi.ModTime()) {
+		return entry.tags, nil
+	}
+
+	tags, err := parseTags(path)
+	if err != nil {
+		logme.Debugf("no tags read from %q: %s\n", path, err)
+	}
+	tagCache.Lock()
+	if len(tagCache.entries) >= tagCacheSize {
+		tagCache.entries = make(map[string]tagCacheEntry)
+	}
+	tagCache.entries[path] = tagCacheEntry{size: fi.Size(), modTime: fi.ModTime(), tags: tags}
+	tagCache.Unlock()
+	return tags, nil
+}
+
+// parseTags actually reads the file.
+func parseTags(path string) (*Tags, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	m, err := tag.ReadFrom(f)
+	if err != nil {
+		return nil, err
+	}
+	track, tracks := m.Track()
+	disc, _ := m.Disc()
+	return &Tags{
+		Title:			strings.TrimSpace(m.Title()),
+		Artist:			strings.TrimSpace(m.Artist()),
+		Album:			strings.TrimSpace(m.Album()),
+		AlbumArtist:	strings.TrimSpace(m.AlbumArtist()),
+		Track:			track,
+		Tracks:			tracks,
+		Disc:			disc,
+		Year:			m.Year(),
+		Genre:			strings.TrimSpace(m.Genre()),
+		HasCover:		m.Picture() != nil,
+	}, nil
+}
+
+// readCover returns the embedded cover art of a media file.
+func readCover(path string) (*tag.Picture, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	m, err := tag.ReadFrom(f)
+	if err != nil {
+		return nil, err
+	}
+	if m.Picture() == nil {
+		return nil, fmt.Errorf("%q has no embedded cover art", path)
+	}
+	return m.Picture(), nil
+}
+
+// coverURL is where the embedded cover art of a file can be retrieved.
+func coverURL(path string) string {
+	return urlPathPrefix + "ui/cover?file=" + url.QueryEscape(path)
+}
+
+// sortByAlbum sorts items by album, disc and track number; files without an album tag
+// are grouped by directory instead, and ties are broken by path.
+func sortByAlbum(items []PlayListItem) {
+	albumKey := func(item PlayListItem) string {
+		if item.tags != nil && item.tags.Album != "" {
+			return strings.ToLower(item.tags.Album)
+		}
+		return strings.ToLower(filepath.Dir(item.Name()))
+	}
+	sort.SliceStable(items, func(a, b int) bool {
+		albumA, albumB := albumKey(items[a]), albumKey(items[b])
+		if albumA != albumB {
+			return albumA < albumB
+		}
+		var discA, discB, trackA, trackB int
+		if items[a].tags != nil {
+			discA, trackA = items[a].tags.Disc, items[a].tags.Track
+		}
+		if items[b].tags != nil {
+			discB, trackB = items[b].tags.Disc, items[b].tags.Track
+		}
+		if discA != discB {
+			return discA < discB
+		}
+		if trackA != trackB {
+			return trackA < trackB
+		}
+		return items[a].Name() < items[b].Name()
+	})
+}
+
+/*
+ *  Router functions
+ */
+
+// uiCover handles GET /ui/cover?file=<path>, sending the embedded cover art of a media file.
+// Only files inside the media directory (or the media roots) are accepted.
+func uiCover(c *gin.Context) {
+	file := c.Query("file")
+	if file == "" {
+		checkErrReply(c, http.StatusBadRequest, "cover", fmt.Errorf("empty filename"))
+		return
+	}
+	if !insideDirectory(mediaDirectory.Get(), file) {
+		var err error
+		if file, err = resolveMediaFile(file); err != nil {
+			checkErrReply(c, http.StatusForbidden, "cover", err)
+			return
+		}
+	}
+	picture, err := readCover(file)
+	if err != nil {
+		checkErrReply(c, http.StatusNotFound, "cover", err)
+		return
+	}
+	mimeType := picture.MIMEType
+	if mimeType == "" || !strings.HasPrefix(mimeType, "image/") {
+		mimeType = http.DetectContentType(picture.Data)
+	}
+	c.Header("Cache-Control", "public, max-age=86400")
+	c.Data(http.StatusOK, mimeType, picture.Data)
+}
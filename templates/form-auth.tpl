@@ -15,6 +15,10 @@
 												<label for="objectPIN" class="col-form-label">4-digit Object PIN:</label>
 												<input type="number" max=9999 min=0 maxlength=4 minlength=4 size=4 class="form-control form-control-user" id="objectPIN" name="objectPIN" placeholder="0000" autofocus required>
 											</div>
+											<div class="form-group input-group">
+												<label for="objectKey" class="col-form-label">Registered object key:</label>
+												<input type="text" class="form-control form-control-user" id="objectKey" name="objectKey" placeholder="00000000-0000-0000-0000-000000000000" size=36>
+											</div>
 											<div class="form-group input-group">
 												<label for="masterKey" class="col-form-label">Master key for your LAL server:</label>
 												<input type="text" class="form-control form-control-user" id="masterKey" name="masterKey" placeholder="only you know" size=32 required>
@@ -4,7 +4,21 @@
 						{{- if .Title -}}
 						<h1>{{- .Title -}}</h1>
 						{{- end -}}
-						{{- if .mediaDirectory -}}
+						{{- if .breadcrumbs -}}
+						<div class="row">
+							<nav aria-label="breadcrumb">
+								<ol class="breadcrumb">
+									{{- range $crumb := .breadcrumbs -}}
+									{{- if $crumb.Current }}
+									<li class="breadcrumb-item active" aria-current="page"><i class="bi bi-folder2-open" aria-hidden="true"></i>&nbsp;{{- $crumb.Name -}}</li>
+									{{- else }}
+									<li class="breadcrumb-item"><a href="{{- $crumb.URL -}}">{{- $crumb.Name -}}</a></li>
+									{{- end -}}
+									{{- end }}
+								</ol>
+							</nav>
+						</div>
+						{{- else if .mediaDirectory -}}
 						<div class="row">
 							<div class="alert alert-info" role="info">
 							{{ .mediaDirectory }}
@@ -26,34 +40,69 @@
 							<div class="col-lg-7">
 								<div class="p-5">
 									<form role="form" class="user" action="{{- .URLPathPrefix -}}api/stream" method="POST">
+											<input type="hidden" name="playlistID" value="{{- .playlistID -}}">
+											<input type="hidden" name="selection" value="true">
+											<div class="form-group input-group">
+												<label for="token" class="col-form-label">Token received during authentication:</label>
+												<input type="text" class="form-control form-control-user" id="token" name="token" placeholder="Enter your token here" size=32 required>
+											</div>
 											<div class="container d-flex justify-content-center">
 												<ul class="list-group mt-5 text-white">
 													{{- range $file := .playlist -}}
 													<li class="list-group-item d-flex justify-content-between align-content-center">
 														<div class="d-flex flex-row">
 															{{- if $file.IsDir -}}
+															<a href="{{- browseURL $file.Name -}}">
+															{{- if $file.Cover -}}
+															<img class="album-cover" src="{{- $file.Cover -}}" alt="Album cover">
+															{{- else -}}
 															<i class="bi bi-folder-fill album-cover" style="font-size: 40px; color: var(--yellow);" aria-hidden="true"></i>
+															{{- end -}}
+															</a>
 															{{- else -}}
 															{{- if $file.Cover -}}
 															<img class="album-cover" src="{{- $file.Cover -}}" alt="Album cover">
+															{{- else if $file.IsVideo -}}
+															<i class="bi bi-film album-cover" style="font-size: 40px; color: var(--purple);" aria-hidden="true"></i>
 															{{- else -}}
 															<i class="bi bi-music-note-beamed album-cover" style="font-size: 40px; color: var(--purple);" aria-hidden="true"></i>
 															{{- end -}}
 															{{- end -}}
 															<div class="ml-2 filename-{{- pathEscape $file.Name -}}">
-																<h6 class="mb-0">{{- baseName $file.Name -}}</h6>
+																{{- if $file.IsDir }}
+																<h6 class="mb-0"><a href="{{- browseURL $file.Name -}}">{{- $file.Title -}}</a></h6>
+																<div class="about">
+																	<span><time datetime="{{- formatAsDate $file.ModTime -}}">{{- formatAsDate $file.ModTime -}}</time></span>
+																</div>
+																{{- else }}
+																<h6 class="mb-0">{{- if $file.Tags -}}{{- with $file.Tags.Track -}}{{- . -}}.&nbsp;{{- end -}}{{- end -}}{{- $file.Title -}}</h6>
+																{{- if or $file.Artist $file.Album }}
+																<div class="artist-album">
+																	{{- $file.Artist -}}{{- if and $file.Artist $file.Album }} — {{ end -}}{{- with $file.Album -}}<i>{{- . -}}</i>{{- end -}}
+																	{{- if $file.Tags -}}{{- with $file.Tags.Year }} ({{- . -}}){{- end -}}{{- end -}}
+																</div>
+																{{- end }}
 																<div class="about">
 																	<span>
 																		<integer>{{- $file.Size -}}</integer> bytes
 																	</span>
 																	<span><time datetime="{{- formatAsDate $file.ModTime -}}">{{- formatAsDate $file.ModTime -}}</time></span>
+																	{{- if $file.Duration }}
+																	<span><i class="bi bi-clock" aria-hidden="true"></i>&nbsp;{{- formatDuration $file.Duration -}}</span>
+																	{{- end -}}
+																	{{- with $file.Info }}
+																	<span class="codecs">{{- .Codecs -}}</span>
+																	{{- end -}}
+																	{{- if not $file.Playable }}
+																	<span class="badge badge-danger">cannot be played</span>
+																	{{- end -}}
 																</div>
+																{{- end }}
 															</div>
 														</div> <!-- /d-flex flex-row -->
 														{{- if not $file.IsDir -}}
-														<!-- note: all checkboxes checked & disabled for now -->
 														<div class="check">
-															<input type="checkbox" id="checkbox-{{- pathEscape $file.Name -}}" name="{{- pathEscape $file.Name -}}" disabled="disabled" checked>
+															<input type="checkbox" id="checkbox-{{- pathEscape $file.Name -}}" name="files" value="{{- $file.Name -}}"{{- if $file.Checked }} checked{{- end -}}{{- if not $file.Playable }} disabled{{- end -}}>
 														</div>
 														{{- end -}}
 													</li>
@@ -61,6 +110,12 @@
 												</ul>
 											</div> <!-- /container d-flex -->
 											<input type="submit" value="Stream" class="btn btn-primary btn-user btn-sm">
+											{{- if .playlistID -}}
+											<div class="btn-group" role="group" aria-label="Download playlist">
+												<a class="btn btn-secondary btn-user btn-sm" href="{{- .URLPathPrefix -}}ui/playlists/{{- .playlistID -}}/export?format=m3u8" download><i class="bi bi-download" aria-hidden="true"></i>&nbsp;M3U8</a>
+												<a class="btn btn-secondary btn-user btn-sm" href="{{- .URLPathPrefix -}}ui/playlists/{{- .playlistID -}}/export?format=xspf" download><i class="bi bi-download" aria-hidden="true"></i>&nbsp;XSPF</a>
+											</div>
+											{{- end -}}
 									</form>
 								</div> <!-- /p-5 -->
 							</div> <!-- /col lg-7 -->
@@ -0,0 +1,135 @@
+// Video thumbnails, generated by ffmpeg.
+// Videos have no cover art, so a frame from (near) the beginning is used instead; it is
+// extracted the first time it's requested, and kept in the thumbnail directory until the
+// video changes.
+//
+// © 2023 by Gwyneth Llewelyn. All rights reserved.
+// Licensed under a MIT License (see https://gwyneth-llewelyn.mit-license.org/).
+package main
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	thumbnailTimeout	= 30 * time.Second	// ffmpeg should never take this long to extract a single frame.
+	thumbnailWidth		= 320				// in pixels; the height keeps the aspect ratio.
+	thumbnailMaxSeek	= 30				// never look further than this (in seconds) for a frame.
+)
+
+// thumbnailDirectory is where thumbnails are kept; empty disables them.
+var thumbnailDirectory setting[string]
+
+// thumbnailMu makes sure that only one ffmpeg runs at a time to generate thumbnails,
+// since a page full of videos would otherwise launch dozens of them at once.
+var thumbnailMu sync.Mutex
+
+// thumbnailURL is where the thumbnail of a video can be retrieved.
+func thumbnailURL(path string) string {
+	return urlPathPrefix + "ui/thumbnail?file=" + url.QueryEscape(path)
+}
+
+// thumbnailFile returns the path to the thumbnail of a video, generating it if needed.
+func thumbnailFile(path string) (string, error) {
+	if thumbnailDirectory.Get() == "" {
+		return "", fmt.Errorf("thumbnails are disabled")
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	// The name changes whenever the video does, so stale thumbnails are never used.
+	hash := sha1.Sum([]byte(path + "\x00" + strconv.FormatInt(fi.Size(), 10) + "\x00" + fi.ModTime().String()))
+	thumbnail := filepath.Join(thumbnailDirectory.Get(), hex.EncodeToString(hash[:]) + ".jpg")
+	if _, err = os.Stat(thumbnail); err == nil {
+		return thumbnail, nil
+	}
+
+	thumbnailMu.Lock()
+	defer thumbnailMu.Unlock()
+	if _, err = os.Stat(thumbnail); err == nil {	// someone else got here first.
+		return thumbnail, nil
+	}
+	if err = os.MkdirAll(thumbnailDirectory.Get(), 0755); err != nil {
+		return "", err
+	}
+	// Skip the first few seconds, which are often black; short videos get a frame from the start.
+	var seek float64
+	if info, err := probeMedia(path); err == nil {
+		seek = min(info.Duration / 10, thumbnailMaxSeek)
+	}
+	if err = extractFrame(path, thumbnail, seek); err != nil && seek > 0 {
+		logme.Debugf("thumbnail: no frame at %.1fs on %q, trying the first one: %s\n", seek, path, err)
+		err = extractFrame(path, thumbnail, 0)
+	}
+	if err != nil {
+		return "", err
+	}
+	logme.Debugf("thumbnail for %q saved to %q\n", path, thumbnail)
+	return thumbnail, nil
+}
+
+// extractFrame saves a scaled-down frame from the video at `path`, `seek` seconds in, as a JPEG.
+// The frame is saved to a temporary file first, so that a half-written thumbnail is never served.
+func extractFrame(path, thumbnail string, seek float64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), thumbnailTimeout)
+	defer cancel()
+	tmp := thumbnail + ".tmp.jpg"
+	defer os.Remove(tmp)
+	cmd := exec.CommandContext(ctx, ffmpegPath.Get(), "-nostdin", "-loglevel", "error",
+		"-ss", strconv.FormatFloat(seek, 'f', 3, 64), "-i", path,
+		"-frames:v", "1", "-vf", "scale=" + strconv.Itoa(thumbnailWidth) + ":-2", "-y", tmp)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%s: %w (%s)", ffmpegPath.Get(), err, output)
+	}
+	// ffmpeg exits happily without writing anything if there's no frame after `seek`.
+	if fi, err := os.Stat(tmp); err != nil || fi.Size() == 0 {
+		return fmt.Errorf("no frame extracted")
+	}
+	return os.Rename(tmp, thumbnail)
+}
+
+/*
+ *  Router functions
+ */
+
+// uiThumbnail handles GET /ui/thumbnail?file=<path>, sending the thumbnail of a video.
+// Only files inside the media directory (or the media roots) are accepted.
+func uiThumbnail(c *gin.Context) {
+	file := c.Query("file")
+	if file == "" {
+		checkErrReply(c, http.StatusBadRequest, "thumbnail", fmt.Errorf("empty filename"))
+		return
+	}
+	if !insideDirectory(mediaDirectory.Get(), file) {
+		var err error
+		if file, err = resolveMediaFile(file); err != nil {
+			checkErrReply(c, http.StatusForbidden, "thumbnail", err)
+			return
+		}
+	}
+	if !isVideoFile(file) {
+		checkErrReply(c, http.StatusBadRequest, "thumbnail", fmt.Errorf("%q is not a video", file))
+		return
+	}
+	thumbnail, err := thumbnailFile(file)
+	if err != nil {
+		checkErrReply(c, http.StatusNotFound, "thumbnail", err)
+		return
+	}
+	c.Header("Cache-Control", "public, max-age=86400")
+	c.File(thumbnail)
+}
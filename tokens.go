@@ -0,0 +1,218 @@
+// Token storage.
+// Tokens are issued by /api/auth and must be presented to all the other API endpoints.
+// The store is pluggable: the default is the embedded bbolt database, but, should that
+// fail to open, we fall back to a (volatile) in-memory store.
+//
+// © 2023 by Gwyneth Llewelyn. All rights reserved.
+// Licensed under a MIT License (see https://gwyneth-llewelyn.mit-license.org/).
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	bolt "go.etcd.io/bbolt"
+)
+
+// Errors returned when a token cannot be used.
+var (
+	errTokenUnknown	= errors.New("unknown token")
+	errTokenExpired	= errors.New("token has expired")
+	errTokenRevoked	= errors.New("token has been revoked")
+)
+
+// Name of the bucket where tokens are kept.
+var tokenBucket = []byte("tokens")
+
+// Token is what we store for every token issued by /api/auth.
+type Token struct {
+	Token string		`json:"token" xml:"token"`				// the token itself (also the key on the store).
+	ObjectKey string	`json:"objectKey" xml:"objectKey"`		// UUID of the in-world object that requested it.
+	AvatarKey string	`json:"avatarKey" xml:"avatarKey"`		// UUID of the avatar owning that object.
+	Created time.Time	`json:"created" xml:"created"`			// when it was issued.
+	Expires time.Time	`json:"expires" xml:"expires"`			// after this, the token is useless.
+	Revoked bool		`json:"revoked" xml:"revoked"`			// set by /api/delete.
+}
+
+// Valid checks if the token can still be used, returning the reason why not.
+func (t *Token) Valid() error {
+	switch {
+		case t.Revoked:
+			return errTokenRevoked
+		case !t.Expires.IsZero() && time.Now().After(t.Expires):
+			return errTokenExpired
+	}
+	return nil
+}
+
+// TokenStore is implemented by every backend that is able to keep tokens around.
+type TokenStore interface {
+	// Issue generates a new token for the object/avatar pair, valid for `ttl` (zero means forever).
+	Issue(objectKey, avatarKey string, ttl time.Duration) (*Token, error)
+	// Lookup retrieves a token, returning errTokenUnknown if it was never issued.
+	Lookup(token string) (*Token, error)
+	// Revoke marks a token as revoked; it will be kept around, so that we can tell why it fails.
+	Revoke(token string) error
+}
+
+// Global token store and token lifetime.
+var (
+	tokenStore TokenStore
+	tokenTTL setting[time.Duration]	// how long a token is valid; zero means forever.
+)
+
+// newToken fills in a fresh Token.
+func newToken(objectKey, avatarKey string, ttl time.Duration) *Token {
+	now := time.Now()
+	t := &Token{
+		Token:		randomBase64String(32),
+		ObjectKey:	objectKey,
+		AvatarKey:	avatarKey,
+		Created:	now,
+	}
+	if ttl > 0 {
+		t.Expires = now.Add(ttl)
+	}
+	return t
+}
+
+// boltTokenStore keeps tokens on the embedded database, JSON-encoded.
+type boltTokenStore struct {
+	db *bolt.DB
+}
+
+// newBoltTokenStore returns a token store using an already-opened database.
+func newBoltTokenStore(boltDB *bolt.DB) *boltTokenStore {
+	return &boltTokenStore{db: boltDB}
+}
+
+func (s *boltTokenStore) Issue(objectKey, avatarKey string, ttl time.Duration) (*Token, error) {
+	t := newToken(objectKey, avatarKey, ttl)
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		return s.put(tx, t)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func (s *boltTokenStore) Lookup(token string) (*Token, error) {
+	var t Token
+	err := s.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(tokenBucket).Get([]byte(token))
+		if v == nil {
+			return errTokenUnknown
+		}
+		return json.Unmarshal(v, &t)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+func (s *boltTokenStore) Revoke(token string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		v := tx.Bucket(tokenBucket).Get([]byte(token))
+		if v == nil {
+			return errTokenUnknown
+		}
+		var t Token
+		if err := json.Unmarshal(v, &t); err != nil {
+			return err
+		}
+		t.Revoked = true
+		return s.put(tx, &t)
+	})
+}
+
+// put encodes and saves a token inside a writable transaction.
+func (s *boltTokenStore) put(tx *bolt.Tx, t *Token) error {
+	buf, err := json.Marshal(t)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket(tokenBucket).Put([]byte(t.Token), buf)
+}
+
+// memTokenStore is a volatile token store; everything is lost on restart.
+// Used when the database is not available.
+type memTokenStore struct {
+	mu sync.RWMutex
+	tokens map[string]Token
+}
+
+// newMemTokenStore returns an empty in-memory store.
+func newMemTokenStore() *memTokenStore {
+	return &memTokenStore{tokens: make(map[string]Token)}
+}
+
+func (s *memTokenStore) Issue(objectKey, avatarKey string, ttl time.Duration) (*Token, error) {
+	t := newToken(objectKey, avatarKey, ttl)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tokens[t.Token] = *t
+	return t, nil
+}
+
+func (s *memTokenStore) Lookup(token string) (*Token, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	t, ok := s.tokens[token]
+	if !ok {
+		return nil, errTokenUnknown
+	}
+	return &t, nil
+}
+
+func (s *memTokenStore) Revoke(token string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.tokens[token]
+	if !ok {
+		return errTokenUnknown
+	}
+	t.Revoked = true
+	s.tokens[token] = t
+	return nil
+}
+
+// validateToken looks up a token and checks that it's still usable.
+func validateToken(token string) (*Token, error) {
+	if token == "" {
+		return nil, fmt.Errorf("no valid token sent")
+	}
+	if tokenStore == nil {
+		return nil, fmt.Errorf("no token store configured")
+	}
+	t, err := tokenStore.Lookup(token)
+	if err != nil {
+		return nil, err
+	}
+	if err = t.Valid(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// checkToken validates the token sent with a request, as well as whether the object it
+// was issued to may perform `action`; if not, it replies with an error.
+// Returns nil in that case, so callers just need to return.
+func checkToken(c *gin.Context, action string, token string) *Token {
+	t, err := validateToken(token)
+	if err != nil {
+		checkErrReply(c, http.StatusUnauthorized, action, err)
+		return nil
+	}
+	if err = authoriseObject(t.ObjectKey, action); err != nil {
+		checkErrReply(c, http.StatusForbidden, action, err)
+		return nil
+	}
+	return t
+}
@@ -5,16 +5,13 @@
 package main
 
 import (
+	"errors"
 	"fmt"
-//	"io/fs"
+	"io/fs"
 	"net/http"
-	"os"
-	"path/filepath"
-	"strings"
 
 	"github.com/gin-gonic/gin"
 	"github.com/gin-gonic/gin/binding"
-	"github.com/karrick/godirwalk"
 )
 
 /*
@@ -88,145 +85,96 @@ func uiCredits(c *gin.Context) {
 		"Text"			: "One day, we will credit here everybody."		}))
 }
 
-// Displays a page with the contents of the media directory. In the future, checkboxes & changing dir will work, too.
+// Displays a page with the contents of a directory (the media directory, unless `?dir=` is given):
+// its subdirectories, which can be browsed into, and its files, which can be streamed.
 func uiStream(c *gin.Context) {
 	// For type PlayListItem, see playlist.go
 
-	var err error	// for scope issues on calls with multiple return params
 	responseContent := getContentType(c)
 
-	logme.Infoln("streaming from directory:", mediaDirectory)
-
-	playlist = nil	// clear the last playlist and start from scratch.
-	var lastCoverPath string	// 'cache' of the cover art for this directory (= album),
-
-	err = godirwalk.Walk(mediaDirectory,
-		&godirwalk.Options{
-			FollowSymbolicLinks: true,
-			Callback: func(osPathname string, de *godirwalk.Dirent) error {
-				// go one level deeper
-				isDir, dirErr := de.IsDirOrSymlinkToDir();
-				if isDir {
-					if dirErr == nil {
-						logme.Debugf("entering %q (base name: %q)...\n", osPathname, de.Name())
-						// Check for a `Folder.jpg` file
-						coverFile := filepath.Join(osPathname, "Folder.jpg")
-						if potentialCover, err := os.Stat(coverFile); err == nil {
-							logme.Debugf("stat() found an album cover file for %q named %q\n", osPathname, potentialCover.Name())
-							lastCoverPath = filepath.Join(urlPathPrefix, coverFile)
-						} else {
-							logme.Debugf("`Folder.jpg` not found on album at %q; no cover set\n", osPathname)
-						}
-						return nil
-					}
-					logme.Errorf("error while trying to access directory/symlink %q: %s",
-						osPathname, dirErr)
-						return nil 	// or should we return godirwalk.SkipThis?
-				}
-
-				// FileInfo for the file currently being considered.
-				// We need it here because of scope issues. (gwyneth 20230828)
-				// var fiThis fs.FileInfo	// not needed any longer, actually, due to code refactoring.
-
-				// Check if this is a valid audio file, a possible album cover, or none of those.
-				// First, take a look at the extension. We need to make sure we actually get anything,
-				// since an empty extension "" will match *any* file, which is NOT what we want here!
-				fileExtension := strings.ToLower(filepath.Ext(osPathname))
-
-				// TODO(gwyneth): beyond checking the file extension, we should check for its MIME type!
-				if fileExtension != "" {
-					if strings.Contains(validExtensions, fileExtension) {
-						// Ok, this is a valid audio file, so get the fileinfo for this entry:
-						fiThis, err := os.Stat(osPathname)
-						if err != nil {
-							logme.Errorf("stat() failed on file %s: %s\n", osPathname, err)
-							return err
-						}
-						// Add another file to the list...
-						// Note: we will make all checkboxes true for now, to simplify testing; later,
-						// they will be correctly set.
-						temp := NewPlayListItem(*de, filepath.Join(urlPathPrefix, osPathname), lastCoverPath, fiThis.ModTime(), fiThis.Size(), true)
-						playlist = append(playlist, *temp)
-						// All clear, let's move on!
-						return nil
-					} else if strings.Contains(validCoverExtensions, fileExtension) {
-						// this is a potential album cover image; we save it and skip to the next.
-						// Note: multiple files are possible, the (alphabetically) last one will be used.
-						logme.Debugf("potential cover found: %q (unused)\n", lastCoverPath)
-						// Ok, no more processing on this file, we can skip the entry.
-						return godirwalk.SkipThis
-					}
-					// skip this file if not a valid audio file, nor a cover image:
-					logme.Debugf("skipping %q (extension found: %q)...\n", de.Name(), fileExtension)
-					return godirwalk.SkipThis
-				} else {
-					// Rare case where a file hasn't got an extension, so we cannot figure out what its type is.
-					logme.Debugf("empty file extension for %q, skipping...\n", de.Name())
-					return godirwalk.SkipThis
-				}
-			},	// ends Callback
-			ErrorCallback: func(osPathname string, err error) godirwalk.ErrorAction {
-				logme.Errorf("on file %s: %s\n", osPathname, err)
-				return godirwalk.SkipNode
-			},
-			// Called at the end of every directory, after all the children have been invoked.
-			PostChildrenCallback: func(osPathName string, de *godirwalk.Dirent) error {
-				logme.Debugf("finished with directory %q: emptying album cover path (%s)\n", osPathName, lastCoverPath)
-				lastCoverPath = ""
-				return nil
-			},
-			// Unsorted: false, // (optional) set true for faster yet non-deterministic enumeration (see godoc)
-	})	// end options for dirwalk
-	if err != nil {
-		logme.Errorf("sorry, walking through %q got error: %s\n", mediaDirectory, err)
+	// The library index already has durations, codecs, tags etc.; it only needs to be
+	// scanned synchronously if that was never done before (and isn't being done right now).
+	var err error
+	httpStatus := http.StatusBadRequest
+	if !library.Scanned() {
+		if err = library.Rescan(mediaDirectory.Get()); errors.Is(err, errRescanRunning) {
+			err = nil
+		}
+	}
+	dir, dirErr := browseDirectory(c.Query("dir"))
+	if err == nil && dirErr != nil {
+		err = dirErr
+		if errors.Is(err, fs.ErrNotExist) {
+			httpStatus = http.StatusNotFound
+		}
+	}
+	var items, subdirs []PlayListItem
+	if err == nil {
+		logme.Infoln("streaming from directory:", dir)
+		subdirs, err = subdirectories(dir)
+		items = library.Files(dir)
 	}
 	// no need to tranverse everything if we're not in debug mode!
-	if (debug) {
+	if (debug.Get()) {
 		logme.Debugln("Walkthrough finished; let's see what we've got:")
 		// index.
 		var i = 0
-		if len(playlist) != 0 {
-			for _, dirEntry := range playlist {
+		if len(items) != 0 {
+			for _, dirEntry := range items {
 				logme.Debugf("%d: %#v\n", i, dirEntry)
 				i++
 			}
 		}
-		logme.Debugf("%d entries found; Go reports %d elements \n", i, len(playlist))
+		logme.Debugf("%d entries found, %d subdirectories; Go reports %d elements \n", i, len(subdirs), len(items))
 //		logme.Debugf("Currently, error is %v and responseContent is %q\n", err, responseContent)
 	}
 	if err != nil {
 		switch responseContent {
 			case binding.MIMEJSON:
-				c.JSON(http.StatusBadRequest, gin.H{
+				c.JSON(httpStatus, gin.H{
 					"status": "error",
-					"message": "Error streaming from " + mediaDirectory + ": " + err.Error(),
+					"message": "Error streaming from " + mediaDirectory.Get() + ": " + err.Error(),
 				})
 			case binding.MIMEHTML, binding.MIMEPOSTForm, binding.MIMEMultipartPOSTForm:
-				c.HTML(http.StatusBadRequest, "generic.tpl", environment(c, gin.H{
+				c.HTML(httpStatus, "generic.tpl", environment(c, gin.H{
 					"Title"			: "Error during streaming",
-					"description"	: "Failure to stream from " + mediaDirectory,
-					"Text"			: "Error streaming from " + mediaDirectory + ": " + err.Error(),
+					"description"	: "Failure to stream from " + mediaDirectory.Get(),
+					"Text"			: "Error streaming from " + mediaDirectory.Get() + ": " + err.Error(),
 				}))
 			case binding.MIMEXML, "application/soap+xml", binding.MIMEXML2:
-				c.XML(http.StatusBadRequest, gin.H{
+				c.XML(httpStatus, gin.H{
 						"status": "error",
-						"message": "Error streaming from " + mediaDirectory + ": " + err.Error(),
+						"message": "Error streaming from " + mediaDirectory.Get() + ": " + err.Error(),
 					})
 			case binding.MIMEPlain:
 				fallthrough
 			default:
 				// minimalistic output, good for embedding
-				c.String(http.StatusBadRequest, "successfully streamed from " + mediaDirectory)
+				c.String(httpStatus, "successfully streamed from " + mediaDirectory.Get())
 		}
 		return
 	}
+	// Each user gets their own playlist, so that they don't step on each other's toes;
+	// browsing elsewhere replaces it, rather than piling up another one.
+	myPlaylist := playlists.Scan("Scan of " + dir, sessionOwner(c), items)
 
 	c.HTML(http.StatusOK, "streamdir.tpl", environment(c, gin.H{
 		"Title"			 : skipescape("<i class=\"bi bi-music-note-beamed\" aria-hidden=\"true\"></i><i class=\"bi bi-music-note-beamed\" aria-hidden=\"true\"></i>&nbsp;Stream from media directory"),
-		"description"	 : "Streaming from " + mediaDirectory,
-		"Text"			 : fmt.Sprintf("Ready to start streaming from %q with %d entries...", mediaDirectory, len(playlist)),
+		"description"	 : "Streaming from " + dir,
+		"Text"			 : fmt.Sprintf("Ready to start streaming from %q with %d entries and %d subdirectories...%s", dir, len(items), len(subdirs), rescanNote()),
 		"hasDirList"	 : true,
-		"mediaDirectory" : mediaDirectory,
-		"playlist"		 : playlist,
+		"mediaDirectory" : dir,
+		"breadcrumbs"	 : breadcrumbs(dir),
+		"playlist"		 : append(subdirs, items...),
+		"playlistID"	 : myPlaylist.ID,
 	}))
 }
+
+// rescanNote warns that the library is being rescanned, so the list may be incomplete.
+func rescanNote() string {
+	status := library.Status()
+	if !status.Running {
+		return ""
+	}
+	return fmt.Sprintf(" (the library is being rescanned; %d files found so far)", status.Scanned)
+}
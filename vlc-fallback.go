@@ -0,0 +1,14 @@
+//go:build !vlc
+
+// Playlist player for builds without libVLC (i.e. without the `vlc` tag), which need
+// neither cgo nor the VLC development files: audio playlists are streamed by the gapless
+// player instead (see gapless-player.go), via ffmpeg, to the default backend.
+//
+// © 2023 by Gwyneth Llewelyn. All rights reserved.
+// Licensed under a MIT License (see https://gwyneth-llewelyn.mit-license.org/).
+package main
+
+// newPlaylistPlayer returns the playlist player for this build.
+func newPlaylistPlayer() PlaylistPlayer {
+	return newGaplessPlayer()
+}
@@ -0,0 +1,237 @@
+// Filesystem watcher for the media directory.
+// Every directory under the media directory is watched (via inotify, on Linux), following
+// symbolic links just like the walk in walkMedia() does, so that the library index is
+// updated as soon as files come and go. Events come in bursts (e.g. when copying a whole
+// album), so they are debounced: nothing happens until things have been quiet for a while.
+//
+// © 2023 by Gwyneth Llewelyn. All rights reserved.
+// Licensed under a MIT License (see https://gwyneth-llewelyn.mit-license.org/).
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/karrick/godirwalk"
+)
+
+// watchDebounce is how long the media directory must be quiet before changes are indexed;
+// zero disables the watcher.
+var watchDebounce setting[time.Duration]
+
+// MediaWatcher keeps the library index up to date with the media directory.
+type MediaWatcher struct {
+	mu sync.Mutex
+	watcher *fsnotify.Watcher
+	lib *Library
+	watched map[string]string		// watched directory → its canonical path (i.e. with symlinks resolved).
+	pending map[string]bool			// paths with events since the last flush.
+	timer *time.Timer				// fires after watchDebounce without events.
+	debounce time.Duration
+	done chan struct{}
+}
+
+// Global media watcher; nil if not running.
+var mediaWatcher *MediaWatcher
+
+// NewMediaWatcher starts watching `root` (recursively), updating `lib` on changes.
+func NewMediaWatcher(root string, lib *Library, debounce time.Duration) (*MediaWatcher, error) {
+	fsWatcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	w := &MediaWatcher{
+		watcher:	fsWatcher,
+		lib:		lib,
+		watched:	make(map[string]string),
+		pending:	make(map[string]bool),
+		debounce:	debounce,
+		done:		make(chan struct{}),
+	}
+	w.addTree(absPath(root))
+	logme.Infof("watching %d directories under %q for changes\n", len(w.watched), root)
+	go w.run()
+	return w, nil
+}
+
+// Close stops watching.
+func (w *MediaWatcher) Close() error {
+	close(w.done)
+	w.mu.Lock()
+	if w.timer != nil {
+		w.timer.Stop()
+	}
+	w.mu.Unlock()
+	return w.watcher.Close()
+}
+
+// addTree watches `dir` and all directories under it, following symbolic links.
+// Directories that are already watched (under any name) are skipped, so that symlink
+// loops don't send us around in circles.
+func (w *MediaWatcher) addTree(dir string) {
+	if !w.addDir(dir) {
+		return
+	}
+	err := godirwalk.Walk(dir, &godirwalk.Options{
+		FollowSymbolicLinks: true,
+		Callback: func(osPathname string, de *godirwalk.Dirent) error {
+			if osPathname == dir {
+				return nil
+			}
+			if isDir, err := de.IsDirOrSymlinkToDir(); err != nil || !isDir {
+				return nil
+			}
+			if !w.addDir(osPathname) {
+				return godirwalk.SkipThis
+			}
+			return nil
+		},
+		ErrorCallback: func(osPathname string, err error) godirwalk.ErrorAction {
+			logme.Errorf("watcher: on %s: %s\n", osPathname, err)
+			return godirwalk.SkipNode
+		},
+	})
+	if err != nil {
+		logme.Errorf("watcher: could not walk %q: %s\n", dir, err)
+	}
+}
+
+// addDir watches a single directory, unless its canonical path is already being watched.
+func (w *MediaWatcher) addDir(dir string) bool {
+	canonical, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		logme.Debugf("watcher: cannot resolve %q: %s\n", dir, err)
+		return false
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if _, ok := w.watched[dir]; ok {
+		return false
+	}
+	for _, other := range w.watched {
+		if other == canonical {
+			logme.Debugf("watcher: %q is already watched under another name\n", dir)
+			return false
+		}
+	}
+	if err = w.watcher.Add(dir); err != nil {
+		// usually, this means that fs.inotify.max_user_watches must be raised.
+		logme.Errorf("watcher: cannot watch %q: %s\n", dir, err)
+		return false
+	}
+	w.watched[dir] = canonical
+	return true
+}
+
+// forget stops tracking a directory (and everything under it) that is gone.
+// The kernel removes the watches by itself.
+func (w *MediaWatcher) forget(path string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for dir := range w.watched {
+		if dir == path || insideDirectory(path, dir) {
+			delete(w.watched, dir)
+		}
+	}
+}
+
+// run handles events until the watcher is closed.
+func (w *MediaWatcher) run() {
+	for {
+		select {
+			case <-w.done:
+				return
+			case event, ok := <-w.watcher.Events:
+				if !ok {
+					return
+				}
+				w.handle(event)
+			case err, ok := <-w.watcher.Errors:
+				if !ok {
+					return
+				}
+				// the kernel queue may have overflowed, so we might have missed something.
+				logme.Errorf("watcher: %s; starting a full rescan\n", err)
+				if err := w.lib.StartRescan(mediaDirectory.Get()); err != nil {
+					logme.Debugf("watcher: %s\n", err)
+				}
+		}
+	}
+}
+
+// handle takes note of an event, and (re)starts the debounce timer.
+func (w *MediaWatcher) handle(event fsnotify.Event) {
+	if event.Has(fsnotify.Chmod) && !event.Has(fsnotify.Create | fsnotify.Write | fsnotify.Remove | fsnotify.Rename) {
+		return
+	}
+	logme.Debugf("watcher: %s\n", event)
+	// new directories (or symlinks to directories) must be watched right away, or we'd
+	// miss whatever is copied into them.
+	if event.Has(fsnotify.Create) {
+		if fi, err := os.Stat(event.Name); err == nil && fi.IsDir() {
+			w.addTree(event.Name)
+		}
+	}
+	if event.Has(fsnotify.Remove) || event.Has(fsnotify.Rename) {
+		w.forget(event.Name)
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.pending[event.Name] = true
+	if w.timer == nil {
+		w.timer = time.AfterFunc(w.debounce, w.flush)
+	} else {
+		w.timer.Reset(w.debounce)
+	}
+}
+
+// flush updates the index for all paths with pending events.
+func (w *MediaWatcher) flush() {
+	w.mu.Lock()
+	pending := w.pending
+	w.pending = make(map[string]bool)
+	w.mu.Unlock()
+
+	// If a directory is pending, there's no need to refresh anything inside it.
+	for path := range pending {
+		for other := range pending {
+			if other != path && insideDirectory(other, path) {
+				delete(pending, path)
+				break
+			}
+		}
+	}
+	for path := range pending {
+		if err := w.lib.Refresh(path); err != nil {
+			logme.Errorf("watcher: could not refresh %q: %s\n", path, err)
+		}
+	}
+}
+
+// startWatcher starts watching the media directory, unless disabled.
+func startWatcher() {
+	if watchDebounce.Get() <= 0 {
+		logme.Infoln("media directory watcher disabled")
+		return
+	}
+	var err error
+	if mediaWatcher, err = NewMediaWatcher(mediaDirectory.Get(), library, watchDebounce.Get()); err != nil {
+		logme.Errorf("could not watch the media directory: %s\n", err)
+	}
+}
+
+// restartWatcher stops watching, and starts again (unless disabled), e.g. after the media
+// directory changed.
+func restartWatcher() {
+	if mediaWatcher != nil {
+		if err := mediaWatcher.Close(); err != nil {
+			logme.Errorf("could not stop watching the media directory: %s\n", err)
+		}
+		mediaWatcher = nil
+	}
+	startWatcher()
+}